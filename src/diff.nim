@@ -7,7 +7,9 @@
 ## This library provides methods for comparing two sequences.
 ##
 ## The sequences could be seq[string] of words, or any other sequence
-## providing the elements support ``==`` and ``hash()``.
+## providing the elements support ``==`` and ``hash()``. For example,
+## binary records held as ``seq[seq[byte]]`` can be diffed directly,
+## without converting each record to a string.
 ##
 ## If you only need to compare each pair of sequences once, use
 ## ``spans(a, b)`` if you only need indexes, or ``spanSlices(a, b)`` if
@@ -47,11 +49,22 @@
 ## For other Nim code see `FOSS <http://www.qtrac.eu/sitemap.html#foss>`_.
 
 import algorithm
+import hashes
+import json
 import math
+import options
 import sequtils
-import sets
+import streams
+import strformat
+import strutils
 import sugar
 import tables
+from unicode import isCombining, Rune, runes, toUTF8
+from xmltree import escape
+
+const Version* = "0.5.0"
+  ## The library's version, which must be the same as in diff.nimble (the
+  ## tests check this).
 
 type
   Match* = tuple[aStart, bStart, length: int]
@@ -59,6 +72,38 @@ type
   Span* = tuple[tag: Tag, aStart, aEnd, bStart, bEnd: int]
 
   SpanSlice*[T] = tuple[tag: Tag, a, b: seq[T]]
+    ## Unlike a ``Span``, a ``SpanSlice`` holds the items themselves:
+    ## ``a`` has the items from ``a`` and ``b`` the items from ``b``, so
+    ## a ``tagReplace`` slice has both the "before" and "after" items
+    ## (see ``replacePair()``).
+
+  GridRow* = tuple[tag: Tag, aRow, bRow: int, cells: seq[Span]]
+
+  Edit*[T] = tuple[aStart, aEnd: int, newItems: seq[T]]
+
+  NormalizedSpan* = tuple[span: Span, dirty: bool]
+
+  MovedSpan* = tuple[span: Span, moved: int]
+
+  AlignedRow* = tuple[left, right: Option[string]]
+
+  HunkHeader* = tuple[aStart, aCount, bStart, bCount: int]
+
+  Hunk* = tuple[header: HunkHeader, spans: seq[Span]]
+
+  Conflict*[T] = tuple[index: int, base, mine, theirs: seq[T]]
+
+  RecordChange*[K, V] = tuple[
+    key: K, fields: OrderedTable[string, tuple[before, after: V]]]
+
+  RecordChanges*[K, V] = tuple[added, removed: seq[K],
+                               changed: seq[RecordChange[K, V]]]
+
+  Operation*[T] = tuple[tag: Tag, item: T]
+
+  PatchItem*[T] = tuple[span: Span, items: seq[T]]
+
+  Patch*[T] = seq[PatchItem[T]]
 
   Tag* = enum
     tagEqual = "equal"
@@ -66,14 +111,176 @@ type
     tagDelete = "delete"
     tagReplace = "replace"
 
+  Opcode* = tuple[tag: string, i1, i2, j1, j2: int]
+
+  Scanner*[T] = proc(): tuple[item: T, ok: bool]
+
+  Formatter*[T] = proc(stream: Stream, diff: Diff[T])
+
+  Keyed* = concept item
+    ## Any type with a ``diffKey()`` proc returning its identity as a
+    ## string (see ``newKeyedDiff()``).
+    item.diffKey() is string
+
+  DiffKind* = enum
+    kindIdentical = "identical"
+    kindPureInsert = "pure insert"
+    kindPureDelete = "pure delete"
+    kindMixed = "mixed"
+
+  TransitionKind* = enum
+    transitionKeep = "keep"
+    transitionAdd = "add"
+    transitionRemove = "remove"
+
+  Transition*[T] = tuple[item: T, kind: TransitionKind,
+                         fromIndex, toIndex: int]
+
+  AnchoredChange*[T] = tuple[span: Span, before, after: Option[T]]
+
+  Boundary* = enum
+    boundaryLeading = "leading"
+    boundaryTrailing = "trailing"
+    boundaryMinimalReplace = "minimal-replace"
+
   Diff*[T] = object
     a*: seq[T]
     b*: seq[T]
-    b2j: Table[T, seq[int]]
+    b2j: Table[Hash, int] # item's hash -> index in bIndexes
+    bIndexes: seq[seq[int]] # each item's ascending indexes in b
+    spareIndexes: seq[seq[int]] # emptied bIndexes kept for reuse
+    autoJunk: bool
+    autoJunkMin: int
+    autoJunkFallback: bool
+    maxWork: int
+    maxQueue: int
+    boundary: Boundary
+    popular: seq[T]
+    progress: proc(done, total: int)
+    eq: proc(x, y: T): bool
+    hasher: proc(item: T): Hash
+    isJunk: proc(x: T): bool
+    replaceThreshold: float
+    aTies: seq[Hash] # hashes of a's tie-break keys (see newKeyDiff)
+    bTies: seq[Hash] # hashes of b's tie-break keys
+    spanCache: seq[Span] # see spanAt()
+    spansCached: bool
+
+  SequenceMatcher*[T] = Diff[T]
+
+  PatchError* = object of ValueError
+    index*: int # of the first invalid span (len(patch) if it's missing)
+
+  TransformedDiff*[T, K] = object
+    a*: seq[T]
+    b*: seq[T]
+    keys*: Diff[K] # the diff of the transformed items
+
+  ProjectedDiff*[A, B, K] = object
+    a*: seq[A]
+    b*: seq[B]
+    keys*: Diff[K] # the diff of the projected items
+
+const Tags* = [tagEqual, tagInsert, tagDelete, tagReplace]
+  ## All the tags in order, e.g., for building tables keyed by tag.
 
-proc newDiff*[T](a, b: seq[T]): Diff[T] =
+proc newDiff*[T](a, b: seq[T]; autoJunk = true, autoJunkMin = 200,
+                 maxWork = 0, maxQueue = 0, boundary = boundaryLeading,
+                 progress: proc(done, total: int) = nil,
+                 eq: proc(x, y: T): bool = nil,
+                 hasher: proc(item: T): Hash = nil,
+                 isJunk: proc(x: T): bool = nil,
+                 replaceThreshold = 0.0,
+                 autoJunkFallback = false): Diff[T] =
   ## Creates a new ``Diff`` and computes the comparison data.
   ##
+  ## If ``autoJunk`` is ``true`` (the default) and ``b`` has more than
+  ## ``autoJunkMin`` items (200 by default), any item that occurs more than
+  ## 1% of the time in ``b`` is treated as "popular" and isn't used to
+  ## anchor matches.
+  ##
+  ## Crossing the ``autoJunkMin`` threshold doesn't normally change the
+  ## diff, but it can when popular items are the only possible anchors
+  ## (e.g., when ``b`` consists of a few often repeated items), since they
+  ## then can't be matched at all, and the diff is much coarser. If
+  ## predictability matters more than speed, use a larger
+  ## ``autoJunkMin`` or set ``autoJunk`` to ``false``.
+  ##
+  ## If ``autoJunkFallback`` is ``true`` and popular items were found,
+  ## then whenever the matches leave the sequences almost completely
+  ## different (i.e., with a similarity of less than 0.1, see
+  ## ``ratio()``), they are computed again with ``autoJunk`` off, and
+  ## those matches are used instead. This gives good results for highly
+  ## repetitive inputs without having to tune ``autoJunk`` for them, at
+  ## the cost of computing the comparison data and the matches twice for
+  ## inputs that really are very different, and of the (potentially much
+  ## slower) matching without popular items being excluded.
+  ##
+  ## If ``maxWork`` is greater than 0 it is the budget for computing the
+  ## matches, measured in candidate comparisons (i.e., the number of
+  ## times an item in ``a`` is compared with a position in ``b`` where the
+  ## same item occurs). If the budget is exceeded the matching is
+  ## abandoned and the diff degrades to a single span covering both
+  ## sequences (normally ``tagReplace``). This is useful for bounding the
+  ## time spent on untrusted or pathological inputs.
+  ##
+  ## The matching isn't recursive: it uses a queue of the ranges still to
+  ## be matched, so it can't overflow the stack. Besides the comparison
+  ## data (which is proportional to ``len(b)``), it uses memory
+  ## proportional to ``len(b)`` for finding each match, and to the number
+  ## of matches and the length of the queue. The queue grows by at most
+  ## one range per match found, so can approach the number of matches
+  ## for inputs with many short matches. If ``maxQueue`` is greater than
+  ## 0 and the queue grows longer than it, the matching is abandoned just
+  ## as when ``maxWork`` is exceeded.
+  ##
+  ## The ``boundary`` determines which match is used when there are
+  ## several equally long candidates: ``boundaryLeading`` (the default)
+  ## prefers the earliest, ``boundaryTrailing`` prefers the latest, and
+  ## ``boundaryMinimalReplace`` computes the matches both ways and uses
+  ## whichever leads to the fewest items in ``tagReplace`` spans
+  ## (preferring leading if they tie).
+  ##
+  ## If ``progress`` is given it is called repeatedly while the matches
+  ## are computed, with ``total`` set to ``len(a) + len(b)`` and ``done``
+  ## set to how many of those items have been resolved (i.e., matched or
+  ## known to differ) so far. This is approximate (e.g., it can reach
+  ## ``total`` more than once with ``boundaryMinimalReplace``), but is
+  ## sufficient for showing a rough progress bar for huge inputs. It is
+  ## only ever called from within methods such as ``matches()`` and
+  ## ``spans()``, never after they have returned.
+  ##
+  ## If ``eq`` is given, items that are equal (i.e., have the same hash and
+  ## are ``==``) are only matched if ``eq`` also returns ``true`` for them.
+  ## This allows items to be bucketed loosely by their ``hash()`` and
+  ## ``==``, yet only matched when they strictly agree.
+  ##
+  ## If ``hasher`` is given it is used instead of ``hash()`` to bucket the
+  ## items, e.g., to use a cheaper hash for large items. It need not be
+  ## collision-free since items are only ever matched if they are also
+  ## ``==``, but it must give equal hashes for ``==`` items, and the more
+  ## collisions there are, the slower the diff (and with ``autoJunk``,
+  ## popularity is judged per hash rather than per item).
+  ##
+  ## If ``isJunk`` is given, it works just like the ``isjunk`` argument
+  ## to Python difflib's ``SequenceMatcher``: items in ``b`` for which it
+  ## returns ``true`` are never used to anchor matches, but matches are
+  ## extended over adjacent equal junk items. So for the same sequences
+  ## and junk predicate, ``matches()``, ``ratio()``, ``spans()``, etc.,
+  ## give the same results as difflib. (Except that difflib's autojunk
+  ## applies when ``b`` has 200 *or more* items, so for identical results
+  ## use ``autoJunkMin = 199``, as ``newSequenceMatcher()`` does.)
+  ##
+  ## If ``replaceThreshold`` is greater than 0.0, ``diff.spans()`` yields
+  ## any replacement whose two sides are less similar than this (i.e.,
+  ## whose own ``ratio()`` is lower), as a ``tagDelete`` span immediately
+  ## followed by a ``tagInsert`` span. This avoids presenting unrelated
+  ## items as if one had been changed into the other just because they
+  ## happen to be adjacent. (The matches are unaffected.) This isn't done
+  ## if the ``maxWork`` or ``maxQueue`` limit is exceeded, either for the
+  ## whole diff or for comparing a replacement's sides (which uses the
+  ## same limits).
+  ##
   ## To get all the spans (equals, insertions, deletions, replacements)
   ## necessary to convert sequence `a` into `b`, use ``diff.spans()``.
   ##
@@ -84,70 +291,847 @@ proc newDiff*[T](a, b: seq[T]): Diff[T] =
   ## ``diff.matches()``, and then use ``spansForMatches()``.
   result.a = a
   result.b = b
-  result.b2j = initTable[T, seq[int]]()
+  result.b2j = initTable[Hash, int]()
+  result.autoJunk = autoJunk
+  result.autoJunkMin = autoJunkMin
+  result.autoJunkFallback = autoJunkFallback
+  result.maxWork = maxWork
+  result.maxQueue = maxQueue
+  result.boundary = boundary
+  result.progress = progress
+  result.eq = eq
+  result.hasher = hasher
+  result.isJunk = isJunk
+  result.replaceThreshold = replaceThreshold
   result.chain_b_seq()
 
+proc newKeyDiff*[T, K](a, b: seq[T], key: proc(item: T): K): Diff[K] =
+  ## Creates a new ``Diff`` of the keys of the items in ``a`` and ``b``,
+  ## e.g., one field of each object, which must support ``==`` and
+  ## ``hash()``. The resultant spans' indexes apply equally to ``a`` and
+  ## ``b``.
+  newDiff(a.map(key), b.map(key))
+
+proc newKeyDiff*[T, K, S](a, b: seq[T], key: proc(item: T): K,
+                          tieBreak: proc(item: T): S): Diff[K] =
+  ## Creates a new ``Diff`` of the keys of the items in ``a`` and ``b``
+  ## (see ``newKeyDiff(a, b, key)``), using the ``tieBreak`` secondary
+  ## keys, which must support ``hash()``, to choose between equally long
+  ## candidate matches: the candidate in which the most items' secondary
+  ## keys are also equal is used, so if several items have the same
+  ## (primary) key, they are preferably aligned with the items whose
+  ## secondary keys also match. (The secondary keys are compared by
+  ## their hashes, and are discarded if ``b`` is edited, e.g., with
+  ## ``replaceB()``.)
+  result = newDiff(a.map(key), b.map(key))
+  result.aTies = a.mapIt(hash(tieBreak(it)))
+  result.bTies = b.mapIt(hash(tieBreak(it)))
+
+proc newTransformedDiff*[T, K](a, b: seq[T], transform: proc(item: T): K):
+    TransformedDiff[T, K] =
+  ## Creates a new ``TransformedDiff`` which diffs the ``transform``ed
+  ## items of ``a`` and ``b`` (e.g., lowercased or trimmed strings), which
+  ## must support ``==`` and ``hash()``, but whose ``spanSlices()`` have
+  ## the original items. This is the general form of options such as
+  ## ignoring case or whitespace. (For other results use the ``keys``
+  ## ``Diff``, whose indexes apply equally to ``a`` and ``b``.)
+  result.a = a
+  result.b = b
+  result.keys = newDiff(a.map(transform), b.map(transform))
+
+iterator spans*[T, K](diff: TransformedDiff[T, K]; skipEqual = false,
+                      noReplace = false): Span =
+  ## Yields all the spans necessary to convert the transformed ``a`` into
+  ## the transformed ``b`` (see ``diff.spans()``).
+  for span in diff.keys.spans(skipEqual = skipEqual,
+                              noReplace = noReplace):
+    yield span
+
+iterator spanSlices*[T, K](diff: TransformedDiff[T, K];
+                           skipEqual = false, noReplace = false):
+    SpanSlice[T] =
+  ## Yields all the span slices necessary to convert the transformed
+  ## ``a`` into the transformed ``b`` (see ``spanSlices()``), with the
+  ## original items. So the ``a`` and ``b`` of a ``tagEqual`` slice may
+  ## differ, although their transformed items are the same.
+  for span in diff.spans(skipEqual = skipEqual, noReplace = noReplace):
+    yield newSpanSlice(span.tag, diff.a[span.aStart ..< span.aEnd],
+                       diff.b[span.bStart ..< span.bEnd])
+
+proc newRefDiff*[T](a, b: seq[ref T]): Diff[Option[T]] =
+  ## Creates a new ``Diff`` of the values the refs in ``a`` and ``b``
+  ## point to, rather than of the refs themselves (which would compare
+  ## addresses), e.g., for objects loaded afresh from a database on each
+  ## run. The values must support ``==`` and ``hash()``. The resultant
+  ## spans' indexes apply equally to ``a`` and ``b``.
+  ##
+  ## A ``nil`` ref's value is ``none(T)``, so ``nil`` refs match each
+  ## other but never match a non-``nil`` ref.
+  newDiff(a.mapIt(if it == nil: none(T) else: some(it[])),
+          b.mapIt(if it == nil: none(T) else: some(it[])))
+
+proc newPtrDiff*[T](a, b: seq[ptr T]): Diff[Option[T]] =
+  ## Creates a new ``Diff`` of the values the pointers in ``a`` and ``b``
+  ## point to, treating ``nil`` pointers just like ``newRefDiff()`` treats
+  ## ``nil`` refs.
+  newDiff(a.mapIt(if it == nil: none(T) else: some(it[])),
+          b.mapIt(if it == nil: none(T) else: some(it[])))
+
+proc newProjectedDiff*[A, B, K](a: seq[A], b: seq[B],
+                                keyA: proc(item: A): K,
+                                keyB: proc(item: B): K):
+    ProjectedDiff[A, B, K] =
+  ## Creates a new ``ProjectedDiff`` of sequences of different types via
+  ## a projection of each to a common key type (which must support ``==``
+  ## and ``hash()``), e.g., records from two versions of a schema that
+  ## both have a message field. This is like ``newKeyDiff()`` for
+  ## heterogeneous sequences: the spans' ``a`` indexes apply to ``a`` and
+  ## their ``b`` indexes to ``b``.
+  result.a = a
+  result.b = b
+  result.keys = newDiff(a.map(keyA), b.map(keyB))
+
+iterator spans*[A, B, K](diff: ProjectedDiff[A, B, K]; skipEqual = false,
+                         noReplace = false): Span =
+  ## Yields all the spans necessary to convert the projected ``a`` into
+  ## the projected ``b`` (see ``diff.spans()``).
+  for span in diff.keys.spans(skipEqual = skipEqual,
+                              noReplace = noReplace):
+    yield span
+
+proc newStringKeyDiff*[T](a, b: seq[T]): Diff[string] =
+  ## Creates a new ``Diff`` keyed by each item's ``$`` string (see
+  ## ``newKeyDiff()``). This is convenient, but converting every item to
+  ## a string can be much slower than keying by a field.
+  newDiff(a.mapIt($it), b.mapIt($it))
+
+proc newKeyedDiff*[T: Keyed](a, b: seq[T]): Diff[string] =
+  ## Creates a new ``Diff`` of the ``diffKey()`` strings of the items in
+  ## ``a`` and ``b`` (see ``newKeyDiff()``), for types that have a
+  ## ``diffKey()`` proc.
+  newDiff(a.mapIt(it.diffKey()), b.mapIt(it.diffKey()))
+
+proc setAutoJunk*[T](diff: var Diff[T], autoJunk: bool) =
+  ## Switches the popular item heuristic on or off and recomputes the
+  ## comparison data accordingly.
+  diff.autoJunk = autoJunk
+  diff.dropSpanCache()
+  diff.chain_b_seq()
+
+proc setSeqs*[T](diff: var Diff[T], a, b: seq[T]) =
+  ## Replaces both sequences and recomputes the comparison data, keeping
+  ## all the options the ``Diff`` was created with, so it then gives the
+  ## same results as a new ``Diff`` of ``a`` and ``b`` with those options
+  ## would. This is useful when doing many (e.g., small) diffs, since the
+  ## comparison data's memory is reused rather than reallocated each
+  ## time. (Any tie-break keys from ``newKeyDiff()`` are dropped.)
+  ##
+  ## A ``Diff`` that is reused like this must only be used by one thread
+  ## at a time.
+  diff.a = a
+  diff.b = b
+  diff.dropTies()
+  diff.dropSpanCache()
+  diff.chain_b_seq()
+
+proc popularElements*[T](diff: Diff[T]): seq[T] =
+  ## Returns the items that were treated as "popular" (see ``newDiff()``)
+  ## and so weren't used to anchor matches, in order of their first
+  ## occurrence in ``b``. Returns an empty sequence if ``autoJunk`` is
+  ## ``false`` or ``b`` has ``autoJunkMin`` or fewer items.
+  diff.popular
+
+proc clone*[T](diff: Diff[T]): Diff[T] =
+  ## Returns a copy of the ``Diff`` including its comparison data, so the
+  ## copy can be changed (e.g., with ``setAutoJunk()``) without
+  ## recomputing from scratch and without affecting the original.
+  ##
+  ## The sequences and the comparison data are copied, but the
+  ## ``progress``, ``eq``, ``hasher``, and ``isJunk`` procs are shared
+  ## (along with any state their closures capture), as are any items that
+  ## are refs. (Since ``Diff`` is a value type, plain assignment does the
+  ## same; this just makes the intent explicit.)
+  result = diff
+
+proc newDiff*(a, b: Stream; maxSize = 0, normalizeEol = false):
+    Diff[string] =
+  ## Creates a new ``Diff`` of the lines read from the two streams, i.e.,
+  ## the same as ``newDiff(splitLinesKeepEnds(textA),
+  ## splitLinesKeepEnds(textB))``.
+  ##
+  ## If ``maxSize`` is greater than 0, raises ``ValueError`` if either
+  ## stream has more than ``maxSize`` bytes.
+  ##
+  ## If ``normalizeEol`` is ``true``, both texts' line endings are
+  ## normalized (see ``normalizedEol()``) before they are split into
+  ## lines.
+  var textA = readCapped(a, maxSize)
+  var textB = readCapped(b, maxSize)
+  if normalizeEol:
+    textA = normalizedEol(textA)
+    textB = normalizedEol(textB)
+  newDiff(splitLinesKeepEnds(textA), splitLinesKeepEnds(textB))
+
+proc newScannerDiff*[T](a, b: Scanner[T]; maxItems = 0): Diff[T] =
+  ## Creates a new ``Diff`` of the items produced by the two scanners
+  ## (e.g., lexers). Each scanner is called repeatedly until it returns
+  ## ``ok == false`` and the items are collected into sequences, since
+  ## the matching algorithm needs random access to all of them (i.e., it
+  ## isn't incremental).
+  ##
+  ## If ``maxItems`` is greater than 0, raises ``ValueError`` if either
+  ## scanner produces more than ``maxItems`` items.
+  newDiff(scanAll(a, maxItems), scanAll(b, maxItems))
+
+proc scanAll[T](scanner: Scanner[T], maxItems: int): seq[T] =
+  while true:
+    let (item, ok) = scanner()
+    if not ok:
+      break
+    if maxItems > 0 and len(result) == maxItems:
+      raise newException(ValueError, &"input exceeds {maxItems} items")
+    result.add(item)
+
+proc readCapped(stream: Stream, maxSize: int): string =
+  if maxSize <= 0:
+    return stream.readAll()
+  while not stream.atEnd():
+    let chunk = stream.readStr(min(65536, maxSize - len(result) + 1))
+    if len(chunk) == 0:
+      break
+    result.add(chunk)
+    if len(result) > maxSize:
+      raise newException(ValueError, &"input exceeds {maxSize} bytes")
+
+proc splitLinesKeepEnds*(text: string): seq[string] =
+  ## Returns the lines in the given ``text``, each including its
+  ## terminating ``"\n"``, so joining the lines gives back the original
+  ## ``text`` exactly. The last line has no ``"\n"`` if ``text`` doesn't
+  ## end with one.
+  ##
+  ## So for line diffs of texts split with this, the items are a lossless
+  ## representation of the texts: joining the ``a`` items of all the span
+  ## slices (see ``spanSlices()``) gives back the first text byte for
+  ## byte, and joining their ``b`` items (or those of
+  ## ``applySlices()``) gives back the second, including whether it ends
+  ## with a ``"\n"``. (A changed final newline shows as a replaced last
+  ## line.)
+  var start = 0
+  for (i, c) in text.pairs():
+    if c == '\n':
+      result.add(text[start .. i])
+      start = i + 1
+  if start < len(text):
+    result.add(text[start .. ^1])
+
+proc normalizedEol*(text: string): string =
+  ## Returns the ``text`` with every ``"\r\n"`` and every other
+  ## ``"\r"`` replaced by ``"\n"``. This isn't done by default since it
+  ## would mangle binary-ish data.
+  text.replace("\r\n", "\n").replace('\r', '\n')
+
+proc onlyEolDiffers*(a, b: string): bool =
+  ## Returns ``true`` if ``a`` and ``b`` are different yet have the same
+  ## ``normalizedEol()`` text, i.e., only their line endings differ. This
+  ## is useful for reporting, say, "only line endings changed" rather than
+  ## diffing every line as changed.
+  a != b and normalizedEol(a) == normalizedEol(b)
+
+proc replaceB*[T](diff: var Diff[T], index: int, item: T) =
+  ## Replaces ``b[index]`` with the given ``item`` and updates the
+  ## comparison data to match, hashing only the old and new items rather
+  ## than all of ``b`` (unless ``autoJunk`` is in effect and ``b`` has
+  ## more than ``autoJunkMin`` items, when it is recomputed from scratch).
+  ##
+  ## Only the comparison data is updated: the matches are still computed
+  ## in full by the next call to ``diff.spans()`` etc., since an edit
+  ## anywhere can change which match is the longest, and so the matches
+  ## everywhere. So subsequent calls produce the same results as for a
+  ## new ``Diff`` created with the edited ``b``; the saving is in not
+  ## rehashing ``b``'s items, which is worthwhile when they are costly to
+  ## hash (e.g., long lines).
+  diff.dropTies()
+  diff.dropSpanCache()
+  if diff.b[index] == item:
+    diff.b[index] = item
+  elif diff.needsRechain(len(diff.b)):
+    diff.b[index] = item
+    diff.chain_b_seq()
+  else:
+    diff.removeBIndex(diff.b[index], index)
+    diff.b[index] = item
+    diff.addBIndex(item, index)
+
+proc insertB*[T](diff: var Diff[T], index: int, item: T) =
+  ## Inserts the given ``item`` into ``b`` at position ``index`` and
+  ## updates the comparison data to match (see ``replaceB()``). This
+  ## still adjusts every stored index after ``index``, so it takes time
+  ## proportional to ``len(b)``, but it only hashes the new item.
+  diff.dropTies()
+  diff.dropSpanCache()
+  diff.b.insert(item, index)
+  if diff.needsRechain(len(diff.b)):
+    diff.chain_b_seq()
+  else:
+    for indexes in diff.bIndexes.mitems():
+      for j in indexes.mitems():
+        if j >= index:
+          inc j
+    diff.addBIndex(item, index)
+
+proc deleteB*[T](diff: var Diff[T], index: int) =
+  ## Deletes the item at position ``index`` in ``b`` and updates the
+  ## comparison data to match (see ``replaceB()``). Like ``insertB()``,
+  ## this takes time proportional to ``len(b)`` but only hashes the
+  ## deleted item.
+  diff.dropTies()
+  diff.dropSpanCache()
+  let item = diff.b[index]
+  diff.b.delete(index)
+  if diff.needsRechain(len(diff.b)):
+    diff.chain_b_seq()
+  else:
+    diff.removeBIndex(item, index)
+    for indexes in diff.bIndexes.mitems():
+      for j in indexes.mitems():
+        if j > index:
+          dec j
+
+proc dropTies[T](diff: var Diff[T]) =
+  diff.aTies.setLen(0)
+  diff.bTies.setLen(0)
+
+proc dropSpanCache[T](diff: var Diff[T]) =
+  diff.spanCache.setLen(0)
+  diff.spansCached = false
+
+proc needsRechain[T](diff: Diff[T], length: int): bool =
+  # Popular items depend on the whole of b so can't be updated piecemeal
+  diff.autoJunk and (length > diff.autoJunkMin or len(diff.popular) > 0)
+
+proc addBIndex[T](diff: var Diff[T], item: T, index: int) =
+  if diff.isJunkB(item):
+    return
+  let key = diff.hashOf(item)
+  let slot = diff.b2j.getOrDefault(key, -1)
+  if slot == -1:
+    diff.b2j[key] = len(diff.bIndexes)
+    diff.bIndexes.add(@[index])
+  else:
+    let position = diff.bIndexes[slot].lowerBound(index)
+    diff.bIndexes[slot].insert(index, position)
+
+proc removeBIndex[T](diff: var Diff[T], item: T, index: int) =
+  if diff.isJunkB(item):
+    return
+  let key = diff.hashOf(item)
+  let slot = diff.b2j[key]
+  diff.bIndexes[slot].delete(diff.bIndexes[slot].lowerBound(index))
+  if len(diff.bIndexes[slot]) == 0:
+    diff.b2j.del(key)
+
+proc hashOf[T](diff: Diff[T], item: T): Hash =
+  if diff.hasher == nil: hash(item) else: diff.hasher(item)
+
+proc isJunkB[T](diff: Diff[T], item: T): bool =
+  diff.isJunk != nil and diff.isJunk(item)
+
 proc chain_b_seq[T](diff: var Diff[T]) =
-  for (i, key) in diff.b.pairs():
-    var indexes = diff.b2j.getOrDefault(key, @[])
-    indexes.add(i)
-    diff.b2j[key] = indexes
-  if (let length = len(diff.b); length > 200):
+  diff.b2j.clear()
+  for indexes in diff.bIndexes.mitems():
+    indexes.setLen(0)
+    diff.spareIndexes.add(move(indexes))
+  diff.bIndexes.setLen(0)
+  diff.popular.setLen(0)
+  for (i, item) in diff.b.pairs():
+    if diff.isJunkB(item):
+      continue
+    let key = diff.hashOf(item)
+    let slot = diff.b2j.getOrDefault(key, -1)
+    if slot == -1:
+      diff.b2j[key] = len(diff.bIndexes)
+      var indexes = newSeq[int]()
+      if len(diff.spareIndexes) > 0:
+        indexes = move(diff.spareIndexes[^1])
+        diff.spareIndexes.setLen(len(diff.spareIndexes) - 1)
+      indexes.add(i)
+      diff.bIndexes.add(move(indexes))
+    else:
+      diff.bIndexes[slot].add(i)
+  let length = len(diff.b)
+  if diff.autoJunk and length > diff.autoJunkMin:
+    # Slots are traversed in order (rather than iterating b2j) so that
+    # the popular items are always found in the same order
     let popularLength = int(floor(float(length) / 100.0)) + 1
-    var bPopular = initHashSet[T]()
-    for (element, indexes) in diff.b2j.pairs():
+    for indexes in diff.bIndexes:
       if len(indexes) > popularLength:
-        bPopular.incl(element)
-    for element in bPopular.items():
-      diff.b2j.del(element)
+        diff.popular.add(diff.b[indexes[0]])
+    for element in diff.popular:
+      diff.b2j.del(diff.hashOf(element))
 
-iterator spans*[T](a, b: seq[T]; skipEqual = false): Span =
+iterator spans*[T](a, b: seq[T]; skipEqual = false, noReplace = false):
+    Span =
   ## Directly diffs and yields all the spans (equals, insertions,
   ## deletions, replacements) necessary to convert sequence ``a`` into
   ## ``b``. If ``skipEqual`` is ``true``, spans don't contain
-  ## ``tagEqual``.
+  ## ``tagEqual``. If ``noReplace`` is ``true``, spans don't contain
+  ## ``tagReplace``: each replacement is yielded as a ``tagDelete`` span
+  ## immediately followed by a ``tagInsert`` span.
   ##
   ## If you need *both* the matches *and* the spans, use
   ## ``diff.matches()``, and then use ``spansForMatches()``.
-  let diff = newDiff(a, b, skipEqual = skipEqual)
+  let diff = newDiff(a, b)
   let matches = diff.matches()
-  for span in spansForMatches(matches, skipEqual = skipEqual):
+  for span in spansForMatches(matches, skipEqual = skipEqual,
+                              noReplace = noReplace):
     yield span
 
-iterator spans*[T](diff: Diff[T]; skipEqual = false): Span =
+iterator spans*[T](diff: Diff[T]; skipEqual = false, noReplace = false):
+    Span =
   ## Yields all the spans (equals, insertions, deletions, replacements)
   ## necessary to convert sequence ``a`` into ``b``.
   ## If ``skipEqual`` is ``true``, spans don't contain ``tagEqual``.
+  ## If ``noReplace`` is ``true``, spans don't contain ``tagReplace``:
+  ## each replacement is yielded as a ``tagDelete`` span immediately
+  ## followed by a ``tagInsert`` span.
+  ##
+  ## Unless ``skipEqual`` is ``true``, the spans are contiguous: the first
+  ## span's ``aStart`` and ``bStart`` are 0, each subsequent span's
+  ## ``aStart`` and ``bStart`` are the previous span's ``aEnd`` and
+  ## ``bEnd``, and the last span's ``aEnd`` and ``bEnd`` are ``len(a)``
+  ## and ``len(b)``. So concatenating the spans' ``a`` ranges gives exactly
+  ## ``0 ..< len(a)`` and likewise for ``b``, with no gaps or overlaps,
+  ## even when one sequence is empty. (If both are empty there are no
+  ## spans.)
   ##
   ## If you need *both* the matches *and* the spans, use
-  ## ``diff.matches()``, and then use ``spansForMatches()``.
-  let matches = diff.matches()
-  for span in spansForMatches(matches, skipEqual = skipEqual):
+  ## ``diff.matches()``, and then use ``spansForMatches()``. (This
+  ## ignores ``replaceThreshold``.)
+  let (matches, complete) = diff.checkedMatches()
+  for span in spansForMatches(matches, skipEqual = skipEqual,
+                              noReplace = noReplace):
+    if complete:
+      for part in diff.splitIfUnrelated(span):
+        yield part
+    else: # The maxWork or maxQueue limit was exceeded
+      yield span
+
+iterator splitIfUnrelated[T](diff: Diff[T], span: Span): Span =
+  # Yields the span as is, or if it is a replacement of unrelated items
+  # (see replaceThreshold), as a deletion followed by an insertion
+  if span.tag == tagReplace and diff.isUnrelated(span):
+    yield newSpan(tagDelete, span.aStart, span.aEnd, span.bStart,
+                  span.bStart)
+    yield newSpan(tagInsert, span.aEnd, span.aEnd, span.bStart,
+                  span.bEnd)
+  else:
     yield span
 
-proc matches*[T](diff: Diff[T]): seq[Match] =
+proc isUnrelated[T](diff: Diff[T], span: Span): bool =
+  if diff.replaceThreshold <= 0.0:
+    return false
+  let replaced = newDiff(diff.a[span.aStart ..< span.aEnd],
+                         diff.b[span.bStart ..< span.bEnd],
+                         autoJunk = false, maxWork = diff.maxWork,
+                         maxQueue = diff.maxQueue, eq = diff.eq,
+                         hasher = diff.hasher)
+  # quickRatio() is an upper bound, so avoids computing the matches for
+  # obviously unrelated items
+  if replaced.quickRatio() < diff.replaceThreshold:
+    return true
+  let (matches, complete) = replaced.checkedMatches()
+  complete and matchedRatio(matches, len(replaced.a), len(replaced.b)) <
+    diff.replaceThreshold
+
+iterator groupedSpans*[T](diff: Diff[T]; context = 3,
+                          isJunk: proc(x: T): bool = nil): seq[Span] =
+  ## Yields groups of spans ("hunks") where each group contains one or
+  ## more changes surrounded by up to ``context`` equal items either side.
+  ## (This is like Python difflib's ``get_grouped_opcodes()``.)
+  ##
+  ## Hunks are only ever split by ``tagEqual`` spans that are longer than
+  ## ``2 * context``, so every change span (e.g., a ``tagReplace``),
+  ## however long, appears whole in exactly one hunk. If ``isJunk`` is
+  ## given, a ``tagEqual`` span whose items are all junk never splits a
+  ## hunk, so changes separated only by, say, blank lines, stay in the
+  ## same hunk however many there are.
+  ##
+  ## Nothing is yielded if the sequences are the same.
+  var spans = newSeq[Span]()
+  for span in diff.spans():
+    spans.add(span)
+  if len(spans) > 0:
+    if spans[0].tag == tagEqual:
+      spans[0] = lastItems(spans[0], context)
+    if spans[^1].tag == tagEqual:
+      spans[^1] = firstItems(spans[^1], context)
+    var group = newSeq[Span]()
+    for span in spans:
+      if span.tag == tagEqual and span.aEnd - span.aStart > 2 * context and
+          not diff.allJunk(span, isJunk):
+        group.add(firstItems(span, context))
+        yield group
+        group = @[lastItems(span, context)]
+      else:
+        group.add(span)
+    if len(group) > 1 or (len(group) == 1 and group[0].tag != tagEqual):
+      yield group
+
+proc hunks*[T](diff: Diff[T], context = 3): seq[Hunk] =
+  ## Returns the diff's hunks (see ``groupedSpans()``), each with its
+  ## spans and its header: the 1-based start and the count of the hunk's
+  ## items in ``a`` and in ``b``, exactly as in the hunk's
+  ## ``@@ -aStart,aCount +bStart,bCount @@`` line in a unified diff with
+  ## the same ``context`` (see ``lineRange()``), e.g., for a custom diff
+  ## view.
+  for group in diff.groupedSpans(context):
+    result.add((hunkHeader(group), group))
+
+proc firstHunks*[T](diff: Diff[T], count: int; context = 3,
+                    exact = true): tuple[hunks: seq[Hunk], more: int] =
+  ## Returns at most the first ``count`` of the diff's hunks (see
+  ## ``hunks()``) and how many ``more`` there are, e.g., to show a preview
+  ## followed by "and N more changes".
+  ##
+  ## The matches are computed lazily (see ``lazyMatches()``), and the
+  ## spans of any hunks after the first ``count`` aren't kept. If
+  ## ``exact`` is ``true`` (the default), all the matches are computed
+  ## to count the rest of the hunks, so ``more`` is exact. Otherwise the
+  ## computation stops as soon as one more hunk is found, so ``more`` is
+  ## 0 if there are no more hunks, or 1 meaning *at least* one more,
+  ## which saves the work of diffing the rest of huge inputs.
+  for group in diff.lazyGroups(context):
+    if len(result.hunks) < count:
+      result.hunks.add((hunkHeader(group), group))
+    else:
+      inc result.more
+      if not exact:
+        break
+
+iterator lazyGroups[T](diff: Diff[T], context: int): seq[Span] =
+  # Yields the same groups as groupedSpans() (without isJunk), but
+  # computing the matches only as needed
+  if diff.maxWork > 0 or diff.maxQueue > 0:
+    # The matches aren't lazy anyway (see lazyMatches()), and spans()
+    # knows whether they were degraded by exceeding a limit
+    for group in diff.groupedSpans(context):
+      yield group
+  else:
+    for group in diff.lazyGroupsUnlimited(context):
+      yield group
+
+iterator lazyGroupsUnlimited[T](diff: Diff[T], context: int): seq[Span] =
+  var group = newSeq[Span]()
+  var i = 0
+  var j = 0
+  for match in diff.lazyMatches():
+    if i < match.aStart or j < match.bStart:
+      let change = newSpan(tagForRanges(i, match.aStart, j,
+                                        match.bStart),
+                           i, match.aStart, j, match.bStart)
+      for part in diff.splitIfUnrelated(change):
+        group.add(part)
+    i = match.aStart + match.length
+    j = match.bStart + match.length
+    if match.length > 0:
+      let span = newSpan(tagEqual, match.aStart, i, match.bStart, j)
+      if len(group) == 0:
+        group.add(lastItems(span, context))
+      elif i - match.aStart > 2 * context:
+        group.add(firstItems(span, context))
+        yield group
+        group = @[lastItems(span, context)]
+      else:
+        group.add(span)
+  if len(group) > 0 and group[^1].tag == tagEqual:
+    group[^1] = firstItems(group[^1], context)
+  if len(group) > 1 or (len(group) == 1 and group[0].tag != tagEqual):
+    yield group
+
+proc hunkHeader(group: seq[Span]): HunkHeader =
+  lineRange(newSpan(tagEqual, group[0].aStart, group[^1].aEnd,
+                    group[0].bStart, group[^1].bEnd))
+
+proc hiddenLines*[T](diff: Diff[T], context = 3):
+    tuple[above, below: int] =
+  ## Returns how many unchanged items of ``a`` come before the first hunk
+  ## and after the last hunk that ``groupedSpans()`` yields for the given
+  ## ``context``, i.e., the items not shown at the start and end of a
+  ## unified diff. Returns ``(0, 0)`` if the sequences are the same.
+  var first = true
+  var last: Span
+  for group in diff.groupedSpans(context):
+    if first:
+      result.above = group[0].aStart
+      first = false
+    last = group[^1]
+  if not first:
+    result.below = len(diff.a) - last.aEnd
+
+proc hunkCount*[T](diff: Diff[T]; context = 3,
+                   isJunk: proc(x: T): bool = nil): int =
+  ## Returns how many groups ``groupedSpans()`` would yield for the given
+  ## ``context`` and ``isJunk``, without building them; 0 if the sequences
+  ## are the same.
+  diff.countHunks(toSeq(diff.spans()), context, isJunk)
+
+proc countHunks[T](diff: Diff[T], spans: seq[Span], context: int,
+                   isJunk: proc(x: T): bool): int =
+  for (i, span) in spans.pairs():
+    if span.tag != tagEqual:
+      if result == 0:
+        result = 1
+    elif i > 0 and i < len(spans) - 1 and
+        span.aEnd - span.aStart > 2 * context and
+        not diff.allJunk(span, isJunk):
+      inc result
+
+proc spanAt*[T](diff: var Diff[T], index: int): Span =
+  ## Returns the span at position ``index`` in ``diff.spans()``, e.g., to
+  ## render spans on demand in a virtual list view. The spans are
+  ## computed on the first call (or on the first call after ``b`` is
+  ## edited, e.g., with ``replaceB()``, or ``setAutoJunk()`` is used),
+  ## and cached in the ``Diff`` for subsequent calls. (If ``a`` or ``b``
+  ## is assigned to directly, create a new ``Diff`` instead.)
+  diff.cacheSpans()
+  diff.spanCache[index]
+
+proc spanCount*[T](diff: var Diff[T]): int =
+  ## Returns the number of spans in ``diff.spans()``, computing and
+  ## caching them if necessary (see ``spanAt()``).
+  diff.cacheSpans()
+  len(diff.spanCache)
+
+proc cacheSpans[T](diff: var Diff[T]) =
+  if not diff.spansCached:
+    diff.spanCache = toSeq(diff.spans())
+    diff.spansCached = true
+
+proc inPlace*(span: Span): bool =
+  ## Returns ``true`` if the span is a ``tagReplace`` that replaces its
+  ## ``a`` items with the same number of ``b`` items, i.e., a positional
+  ## change in place rather than a structural one.
+  span.tag == tagReplace and
+    span.aEnd - span.aStart == span.bEnd - span.bStart
+
+proc explainSpan*[T](diff: Diff[T], span: Span): string =
+  ## Returns a description of why the span (one of ``diff.spans()``) has
+  ## its tag, in terms of the matches either side of it, e.g.,
+  ## ``"insert: between the match a[0..<1] = b[0..<1] and the match
+  ## a[1..<2] = b[2..<3], only b has unmatched items (b[1..<2]), so they
+  ## are inserted"``. This is for debugging surprising diffs (it
+  ## recomputes the matches every time it is called).
+  let aItems = &"a[{span.aStart}..<{span.aEnd}]"
+  let bItems = &"b[{span.bStart}..<{span.bEnd}]"
+  var before = "the start"
+  var after = "the end"
+  for match in diff.matches(withSentinel = false):
+    let text = &"the match a[{match.aStart}..<" &
+      &"{match.aStart + match.length}] = b[{match.bStart}..<" &
+      &"{match.bStart + match.length}]"
+    if match.aStart + match.length == span.aStart and
+        match.bStart + match.length == span.bStart:
+      before = text
+    elif match.aStart == span.aEnd and match.bStart == span.bEnd:
+      after = text
+  let between = &"{span.tag}: between {before} and {after}"
+  case span.tag
+  of tagEqual:
+    &"equal: {aItems} = {bItems} is (part of) a match"
+  of tagInsert:
+    &"{between}, only b has unmatched items ({bItems}), so they are " &
+      "inserted"
+  of tagDelete:
+    &"{between}, only a has unmatched items ({aItems}), so they are " &
+      "deleted"
+  of tagReplace:
+    &"{between}, both a ({aItems}) and b ({bItems}) have unmatched " &
+      "items, so a's are replaced by b's"
+
+proc lineRange*(span: Span): tuple[aFrom, aCount, bFrom, bCount: int] =
+  ## Returns the 1-based start and the count of the span's items in ``a``
+  ## and in ``b``, e.g., for ``@@ -aFrom,aCount +bFrom,bCount @@`` patch
+  ## labels. As in unified diffs, an empty side's start is the (1-based)
+  ## line *after* which the items would go, i.e., 0 for the very start.
+  result.aCount = span.aEnd - span.aStart
+  result.bCount = span.bEnd - span.bStart
+  result.aFrom = if result.aCount == 0: span.aStart else: span.aStart + 1
+  result.bFrom = if result.bCount == 0: span.bStart else: span.bStart + 1
+
+proc firstItems(span: Span, count: int): Span =
+  newSpan(span.tag, span.aStart, min(span.aEnd, span.aStart + count),
+          span.bStart, min(span.bEnd, span.bStart + count))
+
+proc lastItems(span: Span, count: int): Span =
+  newSpan(span.tag, max(span.aStart, span.aEnd - count), span.aEnd,
+          max(span.bStart, span.bEnd - count), span.bEnd)
+
+proc allJunk[T](diff: Diff[T], span: Span, isJunk: proc(x: T): bool):
+    bool =
+  if isJunk == nil:
+    return false
+  for i in span.aStart ..< span.aEnd:
+    if not isJunk(diff.a[i]):
+      return false
+  true
+
+proc matches*[T](diff: Diff[T]; withSentinel = true): seq[Match] =
   ## Returns every ``Match`` between the two sequences.
   ##
   ## The differences are the spans between matches.
   ##
+  ## The matches are in order, no two are adjacent (i.e., adjacent
+  ## matches are merged), and if ``withSentinel`` is ``true`` (the
+  ## default, as ``spansForMatches()`` requires), the last is a
+  ## zero-length sentinel, ``(len(a), len(b), 0)``. Use
+  ## ``withSentinel = false`` to get only the real matches. They are
+  ## returned as a new sequence, so they may be used freely, e.g., as
+  ## the basis for custom alignment or merge algorithms, without
+  ## affecting the ``Diff``.
+  ##
   ## To get all the spans (equals, insertions, deletions, replacements)
   ## necessary to convert sequence ``a`` into ``b``, use ``diff.spans()``.
+  result = diff.checkedMatches().matches
+  if not withSentinel:
+    result.setLen(len(result) - 1)
+
+proc checkedMatches[T](diff: Diff[T]):
+    tuple[matches: seq[Match], complete: bool] =
+  # Returns the matches (with the sentinel), and whether they are
+  # complete, i.e., false if the maxWork or maxQueue limit was exceeded
+  case diff.boundary
+  of boundaryLeading:
+    result = diff.computeMatches(trailing = false)
+  of boundaryTrailing:
+    result = diff.computeMatches(trailing = true)
+  of boundaryMinimalReplace:
+    result = diff.computeMatches(trailing = false)
+    let alternative = diff.computeMatches(trailing = true)
+    if replacedCount(alternative.matches) < replacedCount(result.matches):
+      result = alternative
+  if diff.autoJunkFallback and len(diff.popular) > 0 and
+      matchedRatio(result.matches, len(diff.a), len(diff.b)) < 0.1:
+    var fallback = diff
+    fallback.autoJunkFallback = false
+    fallback.setAutoJunk(false)
+    result = fallback.checkedMatches()
+
+iterator lazyMatches*[T](diff: Diff[T]): Match =
+  ## Yields the same matches as ``matches()`` (including the final
+  ## zero-length sentinel) in the same order, but computes each one only
+  ## as needed, so breaking out of the loop early avoids the work of
+  ## computing the rest. This is useful when, say, only the first few
+  ## matches are needed to show the start of the sequences.
+  ##
+  ## The matches can only be computed lazily when using the default
+  ## ``maxWork``, ``maxQueue``, and ``autoJunkFallback``, and a
+  ## ``boundary`` other than ``boundaryMinimalReplace``; otherwise they
+  ## are all computed first. Either way, any ``progress`` callback is
+  ## called just as for ``matches()``, although when the matches are
+  ## computed lazily, ``done`` only reaches ``total`` if all of them are.
+  if diff.maxWork > 0 or diff.maxQueue > 0 or diff.autoJunkFallback or
+      diff.boundary == boundaryMinimalReplace:
+    for match in diff.matches():
+      yield match
+  else:
+    let trailing = diff.boundary == boundaryTrailing
+    let total = len(diff.a) + len(diff.b)
+    var done = 0
+    var work = 0
+    var pending = newMatch(0, 0, 0)
+    # Each entry is a range that is either still to be matched, or else
+    # is matched and all the ranges before it have been matched
+    var stack = @[(0, len(diff.a), 0, len(diff.b), false)]
+    while len(stack) > 0:
+      let (aStart, aEnd, bStart, bEnd, matched) = stack.pop()
+      if matched:
+        if pending.aStart + pending.length == aStart and
+            pending.bStart + pending.length == bStart:
+          pending.length += aEnd - aStart
+        else:
+          if pending.length > 0:
+            yield pending
+          pending = newMatch(aStart, bStart, aEnd - aStart)
+        continue
+      let match = diff.longestMatchWithin(aStart, aEnd, bStart, bEnd,
+                                          trailing, work)
+      let i = match.aStart
+      let j = match.bStart
+      let k = match.length
+      done += aEnd - aStart + bEnd - bStart
+      if k > 0:
+        if i + k < aEnd and j + k < bEnd:
+          stack.add((i + k, aEnd, j + k, bEnd, false))
+          done -= aEnd - (i + k) + bEnd - (j + k)
+        stack.add((i, i + k, j, j + k, true))
+        if aStart < i and bStart < j:
+          stack.add((aStart, i, bStart, j, false))
+          done -= i - aStart + j - bStart
+      if diff.progress != nil:
+        diff.progress(done, total)
+    if pending.length > 0:
+      yield pending
+    yield newMatch(len(diff.a), len(diff.b), 0)
+
+proc computeMatches[T](diff: Diff[T], trailing: bool):
+    tuple[matches: seq[Match], complete: bool] =
   let aLen = len(diff.a)
   let bLen = len(diff.b)
-  var queue = @[(0, aLen, 0, bLen)]
   var matches = newSeq[Match]()
+  var work = 0
+  if not diff.matchesWithin(0, aLen, 0, bLen, trailing, matches, work):
+    return (@[newMatch(aLen, bLen, 0)], false)
+  (mergedMatches(matches, aLen, bLen), true)
+
+proc matchedRatio(matches: seq[Match], aLen, bLen: int): float =
+  if aLen + bLen == 0:
+    return 1.0
+  var matched = 0
+  for match in matches:
+    matched += match.length
+  2.0 * float(matched) / float(aLen + bLen)
+
+proc replacedCount(matches: seq[Match]): int =
+  for span in spansForMatches(matches, skipEqual = true):
+    if span.tag == tagReplace:
+      result += span.aEnd - span.aStart + span.bEnd - span.bStart
+
+proc matchesWithin[T](diff: Diff[T], aLo, aHi, bLo, bHi: int,
+                      trailing: bool, matches: var seq[Match],
+                      work: var int): bool =
+  # Adds the (unsorted, unmerged) matches within the given ranges and
+  # returns true, or returns false if the work budget or queue limit is
+  # exceeded.
+  let total = len(diff.a) + len(diff.b)
+  var done = total - (aHi - aLo + bHi - bLo)
+  var queue = @[(aLo, aHi, bLo, bHi)]
   while len(queue) > 0:
     let (aStart, aEnd, bStart, bEnd) = queue.pop()
-    let match = diff.longestMatch(aStart, aEnd, bStart, bEnd)
+    let match = diff.longestMatchWithin(aStart, aEnd, bStart, bEnd,
+                                        trailing, work)
+    if diff.maxWork > 0 and work > diff.maxWork:
+      return false
     let i = match.aStart
     let j = match.bStart
     let k = match.length
+    done += aEnd - aStart + bEnd - bStart
     if k > 0:
       matches.add(match)
       if aStart < i and bStart < j:
         queue.add((aStart, i, bStart, j))
+        done -= i - aStart + j - bStart
       if i + k < aEnd and j + k < bEnd:
         queue.add((i + k, aEnd, j + k, bEnd))
+        done -= aEnd - (i + k) + bEnd - (j + k)
+      if diff.maxQueue > 0 and len(queue) > diff.maxQueue:
+        return false
+    if diff.progress != nil:
+      diff.progress(done, total)
+  true
+
+proc mergedMatches(matches: var seq[Match], aLen, bLen: int):
+    seq[Match] =
+  # Sorts the matches, merges adjacent ones, and adds the sentinel.
   matches.sort()
   var aStart = 0
   var bStart = 0
@@ -165,6 +1149,338 @@ proc matches*[T](diff: Diff[T]): seq[Match] =
     result.add(newMatch(aStart, bStart, length))
   result.add(newMatch(aLen, bLen, 0))
 
+proc spansAnchored*[T](diff: Diff[T], anchors: seq[(int, int)]):
+    seq[Span] =
+  ## Returns all the spans (equals, insertions, deletions, replacements)
+  ## necessary to convert sequence ``a`` into ``b``, where each
+  ## ``(aIndex, bIndex)`` anchor is a forced match, and the items between
+  ## consecutive anchors are only ever matched with each other.
+  ##
+  ## This is useful when the sequences have known synchronization points
+  ## (e.g., section headings) that shouldn't be matched with identical
+  ## items elsewhere.
+  ##
+  ## Raises ``ValueError`` if any anchor is out of range, if the anchors
+  ## aren't strictly increasing in both ``a`` and ``b``, or if an anchor's
+  ## ``a`` and ``b`` items aren't equal.
+  ##
+  ## If the ``maxWork`` or ``maxQueue`` limit is exceeded (see
+  ## ``newDiff()``), the anchors are ignored and the diff degrades to a
+  ## single span covering both sequences, just as for ``spans()``.
+  let aLen = len(diff.a)
+  let bLen = len(diff.b)
+  let trailing = diff.boundary == boundaryTrailing
+  var matches = newSeq[Match]()
+  var work = 0
+  var ok = true
+  var aLo = 0
+  var bLo = 0
+  for (i, j) in anchors:
+    if i < aLo or i >= aLen or j < bLo or j >= bLen:
+      raise newException(ValueError,
+                         &"anchor ({i}, {j}) is out of range or order")
+    if not diff.itemsEqual(i, j):
+      raise newException(ValueError,
+                         &"anchor ({i}, {j}) is between unequal items")
+    if ok:
+      ok = diff.matchesWithin(aLo, i, bLo, j, trailing, matches, work)
+    matches.add(newMatch(i, j, 1))
+    aLo = i + 1
+    bLo = j + 1
+  if ok:
+    ok = diff.matchesWithin(aLo, aLen, bLo, bLen, trailing, matches, work)
+  if not ok:
+    matches.setLen(0)
+  for span in spansForMatches(mergedMatches(matches, aLen, bLen)):
+    result.add(span)
+
+proc ratio*[T](diff: Diff[T]): float =
+  ## Returns a measure of the sequences' similarity in the range
+  ## ``0.0 .. 1.0``: 1.0 if they are identical and 0.0 if they have
+  ## nothing in common. (Two empty sequences are considered identical.)
+  ##
+  ## This is ``2.0 * M / T`` where ``M`` is the number of matching items
+  ## and ``T`` is the total number of items in both sequences.
+  matchedRatio(diff.matches(), len(diff.a), len(diff.b))
+
+proc quickRatio*[T](diff: Diff[T]): float =
+  ## Returns an upper bound on ``ratio()`` that is much faster to compute
+  ## (like Python difflib's ``quick_ratio()``), since it only counts the
+  ## items the sequences have in common regardless of their order.
+  let total = len(diff.a) + len(diff.b)
+  if total == 0:
+    return 1.0
+  var available = initCountTable[T]()
+  for item in diff.b:
+    available.inc(item)
+  var matched = 0
+  for item in diff.a:
+    if available.getOrDefault(item) > 0:
+      available.inc(item, -1)
+      inc matched
+  2.0 * float(matched) / float(total)
+
+proc bestMatch*[T](diff: Diff[T], candidates: seq[seq[T]]):
+    tuple[index: int, ratio: float] =
+  ## Returns the index of the candidate most similar to ``b`` and its
+  ## ``ratio()``, or ``(-1, 0.0)`` if there are no candidates. (If
+  ## several are equally similar the first is returned.) This is like
+  ## Python difflib's ``get_close_matches()`` but only for the best match.
+  ##
+  ## Each candidate is compared as the ``a`` sequence, so ``b``'s
+  ## comparison data is computed only once and reused for every
+  ## candidate, and candidates whose ``quickRatio()`` shows they can't be
+  ## more similar than the best so far are skipped. (Any tie-break keys
+  ## from ``newKeyDiff()`` are ignored since they only apply to ``a``.)
+  result = (-1, 0.0)
+  var probe = diff
+  probe.dropTies()
+  for (index, candidate) in candidates.pairs():
+    probe.a = candidate
+    if result.index > -1 and probe.quickRatio() <= result.ratio:
+      continue
+    let similarity = probe.ratio()
+    if result.index == -1 or similarity > result.ratio:
+      result = (index, similarity)
+
+proc spansIfSimilar*[T](diff: Diff[T], minRatio: float):
+    tuple[spans: seq[Span], ok: bool] =
+  ## Returns all the spans and ``true`` if the sequences might be at least
+  ## ``minRatio`` similar; otherwise returns no spans and ``false``
+  ## without computing the matches at all. The decision is based on
+  ## ``quickRatio()``, i.e., an upper bound, so the spans may be returned
+  ## even if ``ratio()`` is less than ``minRatio``.
+  if diff.quickRatio() >= minRatio:
+    result = (toSeq(diff.spans()), true)
+
+proc commonPrefixLen*[T](a, b: seq[T]): int =
+  ## Returns how many leading items ``a`` and ``b`` have in common, e.g.,
+  ## for a quick similarity check without a full diff.
+  let length = min(len(a), len(b))
+  while result < length and a[result] == b[result]:
+    inc result
+
+proc commonSuffixLen*[T](a, b: seq[T]): int =
+  ## Returns how many trailing items ``a`` and ``b`` have in common.
+  ##
+  ## This counts from the ends inwards independently of
+  ## ``commonPrefixLen()``, so for sequences that are mostly the same the
+  ## two may overlap, e.g., for ``a b a`` and ``a b a b a``, both are 3,
+  ## although ``a`` only has 3 items. To trim both affixes, subtract the
+  ## prefix length from the length of the shorter sequence to get the
+  ## most the suffix may be.
+  let length = min(len(a), len(b))
+  while result < length and a[^(result + 1)] == b[^(result + 1)]:
+    inc result
+
+proc alignmentAtoB*[T](diff: Diff[T]): seq[int] =
+  ## Returns, for every index in ``a``, the index of the equal item in
+  ## ``b`` it is aligned with, or -1 if the ``a`` item was deleted or
+  ## replaced. This is useful for keeping two panes scroll-locked.
+  result = newSeqWith(len(diff.a), -1)
+  for match in diff.matches():
+    for k in 0 ..< match.length:
+      result[match.aStart + k] = match.bStart + k
+
+proc alignmentBtoA*[T](diff: Diff[T]): seq[int] =
+  ## Returns, for every index in ``b``, the index of the equal item in
+  ## ``a`` it is aligned with, or -1 if the ``b`` item was inserted or is
+  ## a replacement. (See ``alignmentAtoB()``.)
+  result = newSeqWith(len(diff.b), -1)
+  for match in diff.matches():
+    for k in 0 ..< match.length:
+      result[match.bStart + k] = match.aStart + k
+
+proc ratioExcludingJunk*[T](diff: Diff[T], isJunk: proc(x: T): bool):
+    float =
+  ## Returns the same measure as ``ratio()``, except that items for which
+  ## ``isJunk`` returns ``true`` (e.g., blank lines or lone braces) are
+  ## excluded both from the number of matching items and from the total,
+  ## so the result better reflects the similarity of the meaningful
+  ## items. (If every item is junk the result is 1.0.)
+  var total = 0
+  for item in diff.a:
+    if not isJunk(item):
+      inc total
+  for item in diff.b:
+    if not isJunk(item):
+      inc total
+  if total == 0:
+    return 1.0
+  var matched = 0
+  for match in diff.matches():
+    for i in match.aStart ..< match.aStart + match.length:
+      if not isJunk(diff.a[i]):
+        inc matched
+  2.0 * float(matched) / float(total)
+
+proc detectSwaps*[T](diff: Diff[T], window = 1): seq[MovedSpan] =
+  ## Returns all the diff's spans, each paired with the index (in the
+  ## result) of the span it forms a swap with, or -1 if it isn't part of
+  ## a swap.
+  ##
+  ## A swap is a single item insertion and a single item deletion of an
+  ## equal item (in either order) separated only by at most ``window``
+  ## equal items. For example, for ``foo bar baz quux`` and
+  ## ``foo baz bar quux``, the ``tagInsert`` of ``baz`` and the
+  ## ``tagDelete`` of ``baz`` are paired, so they can be presented as
+  ## ``baz`` and ``bar`` trading places rather than as two unrelated
+  ## changes. (The spans themselves are unchanged.)
+  let spans = toSeq(diff.spans())
+  for span in spans:
+    result.add((span, -1))
+  for i in 0 ..< len(spans):
+    if result[i].moved > -1 or not isSingleChange(spans[i]):
+      continue
+    var gap = 0
+    for j in i + 1 ..< len(spans):
+      let other = spans[j]
+      if other.tag == tagEqual:
+        gap += other.aEnd - other.aStart
+        if gap > window:
+          break
+      else:
+        if isSingleChange(other) and diff.isSwap(spans[i], other):
+          result[i].moved = j
+          result[j].moved = i
+        break
+
+proc isSingleChange(span: Span): bool =
+  (span.tag == tagInsert and span.bEnd - span.bStart == 1) or
+    (span.tag == tagDelete and span.aEnd - span.aStart == 1)
+
+proc isSwap[T](diff: Diff[T], first, second: Span): bool =
+  if first.tag == tagInsert and second.tag == tagDelete:
+    diff.itemsEqual(second.aStart, first.bStart)
+  elif first.tag == tagDelete and second.tag == tagInsert:
+    diff.itemsEqual(first.aStart, second.bStart)
+  else:
+    false
+
+proc changedItems*[T](diff: Diff[T]): tuple[inserted, deleted: seq[T]] =
+  ## Returns every inserted item (i.e., from ``b``) and every deleted item
+  ## (i.e., from ``a``) in diff order. The ``b`` items of a
+  ## ``tagReplace`` span count as inserted and its ``a`` items count as
+  ## deleted.
+  for span in diff.spans(skipEqual = true):
+    result.deleted.add(diff.a[span.aStart ..< span.aEnd])
+    result.inserted.add(diff.b[span.bStart ..< span.bEnd])
+
+proc opCounts*[T](diff: Diff[T]):
+    tuple[equals, inserts, deletes, replaces: int] =
+  ## Returns how many spans there are of each tag, i.e., the number of
+  ## separate edits rather than the number of items changed. (Each
+  ## ``tagReplace`` span counts as one replacement.)
+  for span in diff.spans():
+    case span.tag
+    of tagEqual: inc result.equals
+    of tagInsert: inc result.inserts
+    of tagDelete: inc result.deletes
+    of tagReplace: inc result.replaces
+
+proc kind*[T](diff: Diff[T]): DiffKind =
+  ## Returns how the sequences differ: ``kindIdentical`` if there are only
+  ## ``tagEqual`` spans (or no spans at all); ``kindPureInsert`` if the
+  ## only changes are ``tagInsert`` spans (i.e., ``a`` is a subsequence of
+  ## ``b``); ``kindPureDelete`` if the only changes are ``tagDelete``
+  ## spans (i.e., ``b`` is a subsequence of ``a``); and otherwise
+  ## ``kindMixed``.
+  result = kindIdentical
+  for span in diff.spans(skipEqual = true):
+    let spanKind = case span.tag
+                   of tagInsert: kindPureInsert
+                   of tagDelete: kindPureDelete
+                   else: kindMixed
+    if result == kindIdentical:
+      result = spanKind
+    elif result != spanKind:
+      return kindMixed
+
+proc shortStat*[T](pairs: seq[(seq[T], seq[T])]):
+    tuple[files, insertions, deletions: int] =
+  ## Diffs each ``(a, b)`` pair and returns how many pairs differ along
+  ## with the total number of items inserted and deleted across all of
+  ## them, like ``git diff --shortstat``. (A ``tagReplace`` span counts
+  ## its ``b`` items as insertions and its ``a`` items as deletions.)
+  for (a, b) in pairs:
+    var changed = false
+    for span in spans(a, b, skipEqual = true):
+      changed = true
+      result.insertions += span.bEnd - span.bStart
+      result.deletions += span.aEnd - span.aStart
+    if changed:
+      inc result.files
+
+proc operations*[T](diff: Diff[T]): seq[Operation[T]] =
+  ## Returns one ``Operation`` per item in diff order: a ``tagEqual`` one
+  ## for each item in ``a`` that is equal to one in ``b``, a ``tagDelete``
+  ## one for each deleted ``a`` item, and a ``tagInsert`` one for each
+  ## inserted ``b`` item. A replacement is expanded into deletions of all
+  ## its ``a`` items followed by insertions of all its ``b`` items, so no
+  ## ``tagReplace`` operations are returned.
+  for span in diff.spans(noReplace = true):
+    case span.tag
+    of tagEqual, tagDelete:
+      for i in span.aStart ..< span.aEnd:
+        result.add((span.tag, diff.a[i]))
+    of tagInsert, tagReplace:
+      for j in span.bStart ..< span.bEnd:
+        result.add((span.tag, diff.b[j]))
+
+proc transitions*[T](diff: Diff[T]): seq[Transition[T]] =
+  ## Returns one ``Transition`` per item in diff order (like
+  ## ``operations()``), e.g., for animating the change from ``a`` to
+  ## ``b``: a ``transitionKeep`` one for each item in both, with its
+  ## ``fromIndex`` in ``a`` and ``toIndex`` in ``b``, a
+  ## ``transitionRemove`` one for each deleted item, with its
+  ## ``fromIndex`` and a ``toIndex`` of -1, and a ``transitionAdd`` one
+  ## for each inserted item, with a ``fromIndex`` of -1 and its
+  ## ``toIndex``. The items of a replacement are removed and then added.
+  for span in diff.spans(noReplace = true):
+    case span.tag
+    of tagEqual:
+      for k in 0 ..< span.aEnd - span.aStart:
+        result.add((diff.a[span.aStart + k], transitionKeep,
+                    span.aStart + k, span.bStart + k))
+    of tagDelete:
+      for i in span.aStart ..< span.aEnd:
+        result.add((diff.a[i], transitionRemove, i, -1))
+    of tagInsert, tagReplace:
+      for j in span.bStart ..< span.bEnd:
+        result.add((diff.b[j], transitionAdd, -1, j))
+
+proc anchoredChanges*[T](diff: Diff[T]): seq[AnchoredChange[T]] =
+  ## Returns every span other than ``tagEqual`` ones with its nearest
+  ## unchanged items, i.e., the last item of the closest preceding
+  ## ``tagEqual`` span as ``before`` and the first item of the closest
+  ## following one as ``after``, e.g., for describing a change as
+  ## "inserted after X and before Y". Either is ``none(T)`` if there is
+  ## no such span, i.e., for changes at the start or end.
+  let allSpans = toSeq(diff.spans())
+  var before = none(T)
+  for (index, span) in allSpans.pairs():
+    if span.tag == tagEqual:
+      before = some(diff.a[span.aEnd - 1])
+      continue
+    var after = none(T)
+    for k in index + 1 ..< len(allSpans):
+      if allSpans[k].tag == tagEqual:
+        after = some(diff.a[allSpans[k].aStart])
+        break
+    result.add((span, before, after))
+
+proc `$`*[T](diff: Diff[T]): string =
+  ## Returns a summary of the ``Diff`` for debugging, e.g.,
+  ## ``Diff{len(a)=6 len(b)=4 ratio=0.60 hunks=1}``, where ``hunks`` is
+  ## the ``hunkCount()`` with the default context. The sequences
+  ## themselves are not included since they could be huge, and the
+  ## matches are only computed once for both the ratio and the hunks.
+  let matches = diff.matches()
+  let similarity = matchedRatio(matches, len(diff.a), len(diff.b))
+  let count = diff.countHunks(toSeq(spansForMatches(matches)), 3, nil)
+  &"Diff{{len(a)={len(diff.a)} len(b)={len(diff.b)} " &
+    &"ratio={similarity:.2f} hunks={count}}}"
+
 proc longestMatch*[T](diff: Diff[T], aStart, aEnd, bStart, bEnd: int):
     Match =
   ## Returns the longest ``Match`` between the two given sequences, within
@@ -172,40 +1488,92 @@ proc longestMatch*[T](diff: Diff[T], aStart, aEnd, bStart, bEnd: int):
   ##
   ## This is used internally, but may be useful, e.g., when called
   ## with say, ``diff.longest_match(0, len(a), 0, len(b))``.
+  var work = 0
+  diff.longestMatchWithin(aStart, aEnd, bStart, bEnd,
+                          diff.boundary == boundaryTrailing, work)
+
+proc longestMatchWithin[T](diff: Diff[T], aStart, aEnd, bStart, bEnd: int,
+                           trailing: bool, work: var int): Match =
   var bestI = aStart
   var bestJ = bStart
   var bestSize = 0
-  var j2Len = initTable[int, int]()
+  # j2Len[j - bStart + 1] is the length of the match ending at a[i - 1]
+  # and b[j]; only the entries listed in used are nonzero
+  var j2Len = newSeq[int](bEnd - bStart + 1)
+  var newJ2Len = newSeq[int](bEnd - bStart + 1)
+  var used = newSeq[int]()
+  var newUsed = newSeq[int]()
   for i in aStart ..< aEnd:
-    var tempJ2Len = initTable[int, int]()
-    var indexes = diff.b2j.getOrDefault(diff.a[i], @[])
-    if len(indexes) > 0:
-      for j in indexes:
+    let slot = diff.b2j.getOrDefault(diff.hashOf(diff.a[i]), -1)
+    if slot != -1:
+      for j in diff.bIndexes[slot]:
         if j < bStart:
           continue
         if j >= bEnd:
           break
-        let k = j2Len.getOrDefault(j - 1, 0) + 1
-        tempJ2Len[j] = k
-        if k > bestSize:
+        inc work
+        if diff.maxWork > 0 and work > diff.maxWork:
+          return newMatch(aStart, bStart, 0)
+        if not diff.itemsEqual(i, j): # hashes can collide
+          continue
+        let k = j2Len[j - bStart] + 1
+        newJ2Len[j - bStart + 1] = k
+        newUsed.add(j - bStart + 1)
+        if k > bestSize or (k == bestSize and
+            diff.preferred(i - k + 1, j - k + 1, bestI, bestJ, k,
+                           trailing)):
           bestI = i - k + 1
           bestJ = j - k + 1
           bestSize = k
-    j2len = tempJ2Len
-  while bestI > aStart and bestJ > bStart and
-      diff.a[bestI - 1] == diff.b[bestJ - 1]:
-    dec bestI
-    dec bestJ
-    inc bestSize
-  while bestI + bestSize < aEnd and bestJ + bestSize < bEnd and
-      diff.a[bestI + bestSize] == diff.b[bestJ + bestSize]:
-    inc bestSize
+    for index in used:
+      j2Len[index] = 0
+    swap(j2Len, newJ2Len)
+    swap(used, newUsed)
+    newUsed.setLen(0)
+  # Extend over equal non-junk (i.e., popular) items and then over equal
+  # junk items, just like difflib
+  for junk in [false, true]:
+    while bestI > aStart and bestJ > bStart and
+        diff.isJunkB(diff.b[bestJ - 1]) == junk and
+        diff.itemsEqual(bestI - 1, bestJ - 1):
+      dec bestI
+      dec bestJ
+      inc bestSize
+    while bestI + bestSize < aEnd and bestJ + bestSize < bEnd and
+        diff.isJunkB(diff.b[bestJ + bestSize]) == junk and
+        diff.itemsEqual(bestI + bestSize, bestJ + bestSize):
+      inc bestSize
   newMatch(bestI, bestJ, bestSize)
 
-iterator spansForMatches*(matches: seq[Match]; skipEqual = false): Span =
+proc preferred[T](diff: Diff[T], i, j, bestI, bestJ, size: int,
+                  trailing: bool): bool =
+  # Returns true if the match at i, j is preferable to the equally long
+  # best match so far: if it has more equal tie-break keys, or if they
+  # have the same number and trailing matches are preferred
+  if len(diff.bTies) > 0:
+    let ties = diff.tieCount(i, j, size)
+    let bestTies = diff.tieCount(bestI, bestJ, size)
+    if ties != bestTies:
+      return ties > bestTies
+  trailing
+
+proc tieCount[T](diff: Diff[T], i, j, size: int): int =
+  for offset in 0 ..< size:
+    if diff.aTies[i + offset] == diff.bTies[j + offset]:
+      inc result
+
+proc itemsEqual[T](diff: Diff[T], i, j: int): bool =
+  diff.a[i] == diff.b[j] and
+    (diff.eq == nil or diff.eq(diff.a[i], diff.b[j]))
+
+iterator spansForMatches*(matches: seq[Match]; skipEqual = false,
+                          noReplace = false): Span =
   ## Yields all the spans (equals, insertions, deletions, replacements)
   ## necessary to convert sequence ``a`` into ``b``, given the precomputed
   ## matches. Drops any ``tagEqual`` spans if ``skipEqual`` is true.
+  ## If ``noReplace`` is true, each replacement is yielded as a
+  ## ``tagDelete`` span immediately followed by a ``tagInsert`` span, so
+  ## the spans still cover both sequences contiguously.
   ##
   ## Use this if you need *both* matches *and* spans, to avoid needlessly
   ## recomputing the matches, i.e., call ``diff.matches()`` to get the
@@ -222,38 +1590,1352 @@ iterator spansForMatches*(matches: seq[Match]; skipEqual = false): Span =
       tag = tagDelete
     elif j < match.bStart:
       tag = tagInsert
-    if tag != tagEqual:
+    if tag == tagReplace and noReplace:
+      yield newSpan(tagDelete, i, match.aStart, j, j)
+      yield newSpan(tagInsert, match.aStart, match.aStart, j, match.bStart)
+    elif tag != tagEqual:
       yield newSpan(tag, i, match.aStart, j, match.bStart)
     i = match.aStart + match.length
     j = match.bStart + match.length
     if match.length != 0 and not skipEqual:
       yield newSpan(tagEqual, match.aStart, i, match.bStart, j)
 
-iterator spanSlices*[T](a, b: seq[T]; skipEqual = false): SpanSlice[T] =
+iterator spanSlices*[T](a, b: seq[T]; skipEqual = false,
+                        noReplace = false): SpanSlice[T] =
   ## Directly diffs and yields all the span texts (equals, insertions,
   ## deletions, replacements) necessary to convert sequence ``a`` into
   ## ``b``.
   ## Drops any ``tagEqual`` spans if ``skipEqual`` is true.
+  ## If ``noReplace`` is true, each replacement is yielded as a
+  ## ``tagDelete`` span immediately followed by a ``tagInsert`` span.
   ## This is designed to make output easier.
   let diff = newDiff(a, b)
+  for span in spansForMatches(diff.matches(), skipEqual = skipEqual,
+                              noReplace = noReplace):
+    yield newSpanSlice[T](span.tag, a[span.aStart ..< span.aEnd],
+                          b[span.bStart ..< span.bEnd])
+
+iterator pairedSpanSlices*(a, b: seq[string]; skipEqual = false,
+                           maxPairing = 0): SpanSlice[string] =
+  ## Directly diffs and yields all the span texts like ``spanSlices()``,
+  ## except that each replacement is split into one-line ``tagReplace``
+  ## slices for each pair of corresponding lines, with any lines that
+  ## can't be paired yielded as ``tagDelete`` or ``tagInsert`` slices.
+  ##
+  ## Lines are paired by the similarity of their characters (see
+  ## ``ratio()``): only lines that are at least half the same are paired,
+  ## and of the possible in-order pairings, the one with the highest total
+  ## similarity is used. This is useful for showing that one line changed
+  ## into another (e.g., to then highlight the changes within the line).
+  ##
+  ## Pairing compares every line of a replacement's ``a`` with every line
+  ## of its ``b``, so takes time proportional to the product of their
+  ## lengths. If ``maxPairing`` is greater than 0, any replacement with
+  ## more lines than that on either side isn't paired at all: it is
+  ## yielded as a ``tagDelete`` slice followed by a ``tagInsert`` slice.
+  ## This bounds the time taken for huge replacements.
+  for span in spans(a, b, skipEqual = skipEqual):
+    for slice in pairedSlices(a, b, span, maxPairing):
+      yield slice
+
+proc alignedRows*(diff: Diff[string], maxPairing = 0): seq[AlignedRow] =
+  ## Returns the rows for showing the lines side by side, e.g., in a
+  ## two-pane editor: each row has a ``left`` line from ``a`` and a
+  ## ``right`` line from ``b``, either of which may be ``none`` as a
+  ## filler. Equal lines are in the same row, as are replaced lines that
+  ## are paired (see ``pairedSpanSlices()``), while deleted lines and
+  ## unpaired replaced lines of ``a`` have ``none`` on the right, and
+  ## inserted lines and unpaired replaced lines of ``b`` have ``none`` on
+  ## the left. (See ``pairedSpanSlices()`` for ``maxPairing``.)
+  for span in diff.spans():
+    for slice in pairedSlices(diff.a, diff.b, span, maxPairing):
+      case slice.tag
+      of tagEqual, tagReplace:
+        for (i, line) in slice.a.pairs():
+          result.add((some(line), some(slice.b[i])))
+      of tagDelete:
+        for line in slice.a:
+          result.add((some(line), none(string)))
+      of tagInsert:
+        for line in slice.b:
+          result.add((none(string), some(line)))
+
+iterator pairedSlices(a, b: seq[string], span: Span, maxPairing: int):
+    SpanSlice[string] =
+  # Yields the span as a slice, or if it is a replacement, as one-line
+  # replacements of paired lines with unpaired lines deleted or inserted
+  if span.tag != tagReplace:
+    yield newSpanSlice(span.tag, a[span.aStart ..< span.aEnd],
+                       b[span.bStart ..< span.bEnd])
+  elif maxPairing > 0 and (span.aEnd - span.aStart > maxPairing or
+                           span.bEnd - span.bStart > maxPairing):
+    yield newSpanSlice(tagDelete, a[span.aStart ..< span.aEnd],
+                       newSeq[string]())
+    yield newSpanSlice(tagInsert, newSeq[string](),
+                       b[span.bStart ..< span.bEnd])
+  else:
+    var similarities = newSeqWith(span.aEnd - span.aStart,
+                                  newSeq[float](span.bEnd - span.bStart))
+    for i in span.aStart ..< span.aEnd:
+      for j in span.bStart ..< span.bEnd:
+        similarities[i - span.aStart][j - span.bStart] =
+          newDiff(toSeq(a[i]), toSeq(b[j])).ratio()
+    var i = span.aStart
+    var j = span.bStart
+    for (pairI, pairJ) in pairUp(similarities, 0.5):
+      if i < span.aStart + pairI:
+        yield newSpanSlice(tagDelete, a[i ..< span.aStart + pairI],
+                           newSeq[string]())
+        i = span.aStart + pairI
+      if j < span.bStart + pairJ:
+        yield newSpanSlice(tagInsert, newSeq[string](),
+                           b[j ..< span.bStart + pairJ])
+        j = span.bStart + pairJ
+      yield newSpanSlice(tagReplace, @[a[i]], @[b[j]])
+      inc i
+      inc j
+    if i < span.aEnd:
+      yield newSpanSlice(tagDelete, a[i ..< span.aEnd], newSeq[string]())
+    if j < span.bEnd:
+      yield newSpanSlice(tagInsert, newSeq[string](), b[j ..< span.bEnd])
+
+proc intralineMarks*(a, b: string): tuple[aMarks, bMarks: string] =
+  ## Diffs the characters (i.e., graphemes, see ``htmlInline()``) of
+  ## ``a`` and ``b`` and returns a marks string for each with a ``^``
+  ## under every changed character and a space under every unchanged one
+  ## (like the ``?`` lines Python's ``difflib.ndiff()`` produces). Each
+  ## marks string has one character per column of its input (see
+  ## ``displayWidth()``), so it aligns with it when both are printed in a
+  ## monospaced font, e.g., a wide (CJK) character gets two marks and a
+  ## combining character none. (Marks follow the logical order of the
+  ## characters, so they only align with right-to-left text if the
+  ## terminal doesn't reorder it.)
+  let aChars = graphemes(a)
+  let bChars = graphemes(b)
+  var aChanged = newSeq[bool](len(aChars))
+  var bChanged = newSeq[bool](len(bChars))
+  for span in spans(aChars, bChars, skipEqual = true):
+    for i in span.aStart ..< span.aEnd:
+      aChanged[i] = true
+    for j in span.bStart ..< span.bEnd:
+      bChanged[j] = true
+  result.aMarks = marksFor(aChars, aChanged)
+  result.bMarks = marksFor(bChars, bChanged)
+
+proc marksFor(chars: seq[string], changed: seq[bool]): string =
+  for (i, text) in chars.pairs():
+    let mark = if changed[i]: '^' else: ' '
+    result.add(strutils.repeat(mark, displayWidth(text)))
+
+proc htmlInline*(a, b: string): string =
+  ## Diffs the characters of ``a`` and ``b`` (e.g., a replaced line and
+  ## its replacement) and returns them merged as HTML with the deleted
+  ## characters wrapped in ``<del>`` and the inserted characters wrapped
+  ## in ``<ins>``, e.g., ``"a <del>b</del><ins>B</ins> c"``. All the text
+  ## is HTML-escaped.
+  ##
+  ## The characters compared are graphemes (i.e., user-perceived
+  ## characters), not runes: a base character with its combining marks,
+  ## a pair of regional indicators (a flag), and an emoji sequence joined
+  ## by zero width joiners or with modifiers, are each a single character,
+  ## so the tags never split them.
+  let aChars = graphemes(a)
+  let bChars = graphemes(b)
+  for span in spans(aChars, bChars):
+    let aText = xmltree.escape(aChars[span.aStart ..< span.aEnd].join())
+    let bText = xmltree.escape(bChars[span.bStart ..< span.bEnd].join())
+    case span.tag
+    of tagEqual:
+      result.add(aText)
+    of tagInsert:
+      result.add(&"<ins>{bText}</ins>")
+    of tagDelete:
+      result.add(&"<del>{aText}</del>")
+    of tagReplace:
+      result.add(&"<del>{aText}</del><ins>{bText}</ins>")
+
+proc graphemes(text: string): seq[string] =
+  # An approximation of Unicode grapheme clusters that keeps combining
+  # marks, variation selectors, emoji modifiers, zero width joiner
+  # sequences, and regional indicator pairs together
+  var regionals = 0 # regional indicators in the current grapheme
+  var joined = false # the previous rune was a zero width joiner
+  for rune in text.runes():
+    let code = int(rune)
+    let regional = code in 0x1F1E6 .. 0x1F1FF
+    if len(result) > 0 and (joined or isCombining(rune) or
+        code == 0x200D or code in 0xFE00 .. 0xFE0F or
+        code in 0x1F3FB .. 0x1F3FF or (regional and regionals == 1)):
+      result[^1].add(rune.toUTF8())
+    else:
+      result.add(rune.toUTF8())
+      regionals = 0
+    if regional:
+      inc regionals
+    joined = code == 0x200D
+
+proc displayWidth*(s: string): int =
+  ## Returns the number of columns ``s`` occupies in a monospaced font:
+  ## East Asian wide and fullwidth characters (e.g., CJK) count as 2,
+  ## combining characters as 0, and all other characters as 1. This is
+  ## used for padding and marks by ``unifiedDiff(alignColumns = true)``
+  ## and ``intralineMarks()``.
+  for rune in s.runes():
+    result += runeWidth(rune)
+
+proc runeWidth(rune: Rune): int =
+  let code = int(rune)
+  if code == 0x200B or isCombining(rune): # zero width space or combining
+    0
+  elif code in 0x1100 .. 0x115F or code in 0x2E80 .. 0x303E or
+      code in 0x3041 .. 0x33FF or code in 0x3400 .. 0x4DBF or
+      code in 0x4E00 .. 0x9FFF or code in 0xA000 .. 0xA4CF or
+      code in 0xAC00 .. 0xD7A3 or code in 0xF900 .. 0xFAFF or
+      code in 0xFE30 .. 0xFE4F or code in 0xFF00 .. 0xFF60 or
+      code in 0xFFE0 .. 0xFFE6 or code in 0x1F300 .. 0x1F64F or
+      code in 0x1F900 .. 0x1F9FF or code in 0x20000 .. 0x3FFFD:
+    2
+  else:
+    1
+
+proc sortedSpans*[T](a, b: seq[T]; skipEqual = false): seq[Span] =
+  ## Returns all the spans (equals, insertions, deletions) necessary to
+  ## convert sequence ``a`` into ``b``, when both are sorted in ascending
+  ## order (e.g., sorted IDs). Rather than the general matching algorithm
+  ## this uses a linear merge, so takes ``O(len(a) + len(b))`` time.
+  ## There are never any ``tagReplace`` spans: if neither sequence has
+  ## duplicates the spans are the same as those from ``spans(a, b,
+  ## skipEqual, noReplace = true)``. (With duplicates the spans are still
+  ## correct but may be aligned differently.)
+  ##
+  ## The sequences must be sorted; this is only checked by an assertion.
+  assert a.isSorted() and b.isSorted(), "the sequences must be sorted"
+  var matches = newSeq[Match]()
+  var aStart = 0
+  var bStart = 0
+  var length = 0
   var i = 0
   var j = 0
-  for match in diff.matches():
-    var tag = tagEqual
-    if i < match.aStart and j < match.bStart:
-      tag = tagReplace
-    elif i < match.aStart:
-      tag = tagDelete
-    elif j < match.bStart:
-      tag = tagInsert
-    if tag != tagEqual:
-      yield newSpanSlice[T](tag, a[i ..< match.aStart],
-                            b[j ..< match.bStart])
-    i = match.aStart + match.length
-    j = match.bStart + match.length
-    if match.length != 0 and not skipEqual:
-      yield newSpanSlice[T](tagEqual, a[match.aStart ..< i],
-                            b[match.bStart ..< j])
+  while i < len(a) and j < len(b):
+    if a[i] < b[j]:
+      inc i
+    elif b[j] < a[i]:
+      inc j
+    else:
+      if length > 0 and aStart + length == i and bStart + length == j:
+        inc length
+      else:
+        if length > 0:
+          matches.add(newMatch(aStart, bStart, length))
+        aStart = i
+        bStart = j
+        length = 1
+      inc i
+      inc j
+  if length > 0:
+    matches.add(newMatch(aStart, bStart, length))
+  matches.add(newMatch(len(a), len(b), 0))
+  for span in spansForMatches(matches, skipEqual = skipEqual,
+                              noReplace = true):
+    result.add(span)
+
+proc normalizedSpans*[T, K](a, b: seq[T], key: proc(item: T): K):
+    seq[NormalizedSpan] =
+  ## Diffs ``a`` and ``b`` by their items' normalized keys (e.g., with
+  ## whitespace stripped for an "ignore whitespace" diff), and returns
+  ## all the spans, each with a ``dirty`` flag. The flag is only ever
+  ## ``true`` for ``tagEqual`` spans whose items have equal keys but are
+  ## not themselves equal (e.g., whitespace-only changes). Equal runs are
+  ## split where the flag changes, so it applies to every item in the
+  ## span.
+  let diff = newDiff(a.map(key), b.map(key))
+  for span in diff.spans():
+    if span.tag != tagEqual:
+      result.add((span, false))
+      continue
+    let length = span.aEnd - span.aStart
+    var start = 0
+    while start < length:
+      let dirty = a[span.aStart + start] != b[span.bStart + start]
+      var finish = start + 1
+      while finish < length and
+          (a[span.aStart + finish] != b[span.bStart + finish]) == dirty:
+        inc finish
+      let i = span.aStart
+      let j = span.bStart
+      result.add((newSpan(tagEqual, i + start, i + finish, j + start,
+                          j + finish), dirty))
+      start = finish
+
+proc indentInsensitiveSpans*(a, b: seq[string]): seq[NormalizedSpan] =
+  ## Diffs ``a`` and ``b`` ignoring each line's leading whitespace (e.g.,
+  ## for reviewing reformatted code), and returns all the spans, each
+  ## with a ``dirty`` flag (see ``normalizedSpans()``). So re-indented
+  ## lines are ``tagEqual`` with ``dirty`` set rather than replacements,
+  ## while content changes (including trailing whitespace changes) are
+  ## still reported as usual. The spans' indexes are into the original
+  ## lines.
+  normalizedSpans(a, b, unindented)
+
+proc unindented(line: string): string = line.strip(trailing = false)
+
+proc interdiff*(base, v1, v2: seq[string]): seq[SpanSlice[string]] =
+  ## Returns how two patches against the same ``base`` differ (i.e., the
+  ## patch from ``base`` to ``v1`` and the one from ``base`` to ``v2``),
+  ## e.g., to review how an amended change differs from the original.
+  ##
+  ## Each patch is rendered as change lines: for each change, a
+  ## ``"@@ -R @@"`` line where ``R`` is the range of ``base`` lines it
+  ## changes (as in a unified diff), followed by the lines it removes
+  ## prefixed with ``"-"`` and the lines it adds prefixed with ``"+"``.
+  ## The result is the diff of the two rendered patches, so changes that
+  ## both patches make identically are in ``tagEqual`` slices, changes
+  ## only ``v1`` makes are in ``a``, and changes only ``v2`` makes are in
+  ## ``b``. If the result has no ``tagEqual`` slices, the patches have no
+  ## changes in common.
+  toSeq(spanSlices(changeLines(base, v1), changeLines(base, v2)))
+
+proc changeLines(base, version: seq[string]): seq[string] =
+  for span in spans(base, version, skipEqual = true):
+    result.add(&"@@ -{unifiedRange(span.aStart, span.aEnd)} @@")
+    for line in base[span.aStart ..< span.aEnd]:
+      result.add("-" & line)
+    for line in version[span.bStart ..< span.bEnd]:
+      result.add("+" & line)
+
+proc diffRows*(a, b: seq[seq[string]], keyCol: int):
+    seq[SpanSlice[seq[string]]] =
+  ## Diffs two tables of rows (e.g., read from CSV files), using the
+  ## ``keyCol`` column of each row as the row's key, and returns the
+  ## span slices necessary to convert ``a`` into ``b``.
+  ##
+  ## Rows are matched purely by their keys, so rows with the same key that
+  ## differ in any other column are returned as ``tagReplace`` spans,
+  ## while rows whose keys are new or removed are returned as
+  ## ``tagInsert`` or ``tagDelete`` spans. Duplicate keys are treated like
+  ## any other repeated item, i.e., they are matched in order of
+  ## occurrence where possible.
+  ##
+  ## Raises ``ValueError`` if any row doesn't have a ``keyCol`` column.
+  let keysA = rowKeys(a, keyCol)
+  let keysB = rowKeys(b, keyCol)
+  for span in spans(keysA, keysB):
+    if span.tag != tagEqual:
+      result.add(newSpanSlice(span.tag, a[span.aStart ..< span.aEnd],
+                              b[span.bStart ..< span.bEnd]))
+      continue
+    let length = span.aEnd - span.aStart
+    var start = 0
+    while start < length:
+      let same = a[span.aStart + start] == b[span.bStart + start]
+      var finish = start + 1
+      while finish < length and
+          (a[span.aStart + finish] == b[span.bStart + finish]) == same:
+        inc finish
+      let i = span.aStart
+      let j = span.bStart
+      result.add(newSpanSlice(if same: tagEqual else: tagReplace,
+                              a[i + start ..< i + finish],
+                              b[j + start ..< j + finish]))
+      start = finish
+
+proc rowKeys(rows: seq[seq[string]], keyCol: int): seq[string] =
+  for (i, row) in rows.pairs():
+    if keyCol < 0 or keyCol >= len(row):
+      raise newException(ValueError, &"row {i} has no column {keyCol}")
+    result.add(row[keyCol])
+
+proc diffGrid*[T](a, b: seq[seq[T]]): seq[GridRow] =
+  ## Diffs two grids (e.g., spreadsheet tables) first by rows and then,
+  ## for rows that have been changed, by columns. Returns one ``GridRow``
+  ## per output row.
+  ##
+  ## Each ``GridRow`` has a ``tag`` and the row indexes in ``a`` and ``b``
+  ## (-1 for an inserted row's ``aRow`` or a deleted row's ``bRow``).
+  ## For ``tagReplace`` rows, ``cells`` holds the column spans (with no
+  ## ``tagEqual`` spans), so only the genuinely changed cells need be
+  ## highlighted. For other rows ``cells`` is empty.
+  ##
+  ## Within a row-level replacement the rows are paired up by similarity
+  ## (see ``ratio()``), only pairing rows that are at least half the same;
+  ## any that can't be paired are returned as deleted or inserted rows.
+  for span in spans(a, b):
+    case span.tag
+    of tagEqual:
+      for k in 0 ..< span.aEnd - span.aStart:
+        result.add(newGridRow(tagEqual, span.aStart + k, span.bStart + k))
+    of tagDelete:
+      for i in span.aStart ..< span.aEnd:
+        result.add(newGridRow(tagDelete, i, -1))
+    of tagInsert:
+      for j in span.bStart ..< span.bEnd:
+        result.add(newGridRow(tagInsert, -1, j))
+    of tagReplace:
+      var similarities = newSeqWith(span.aEnd - span.aStart,
+                                    newSeq[float](span.bEnd - span.bStart))
+      for i in span.aStart ..< span.aEnd:
+        for j in span.bStart ..< span.bEnd:
+          similarities[i - span.aStart][j - span.bStart] =
+            newDiff(a[i], b[j]).ratio()
+      var i = span.aStart
+      var j = span.bStart
+      for (pairI, pairJ) in pairUp(similarities, 0.5):
+        while i < span.aStart + pairI:
+          result.add(newGridRow(tagDelete, i, -1))
+          inc i
+        while j < span.bStart + pairJ:
+          result.add(newGridRow(tagInsert, -1, j))
+          inc j
+        result.add(newGridRow(tagReplace, i, j,
+                              toSeq(newDiff(a[i], b[j]).spans(
+                                skipEqual = true))))
+        inc i
+        inc j
+      while i < span.aEnd:
+        result.add(newGridRow(tagDelete, i, -1))
+        inc i
+      while j < span.bEnd:
+        result.add(newGridRow(tagInsert, -1, j))
+        inc j
+
+proc pairUp(similarities: seq[seq[float]], cutoff: float):
+    seq[tuple[i, j: int]] =
+  # Returns the in-order pairs of indexes whose similarities are at least
+  # the cutoff and that have the highest total similarity.
+  let aCount = len(similarities)
+  let bCount = if aCount == 0: 0 else: len(similarities[0])
+  var scores = newSeqWith(aCount + 1, newSeq[float](bCount + 1))
+  for i in 1 .. aCount:
+    for j in 1 .. bCount:
+      var best = max(scores[i - 1][j], scores[i][j - 1])
+      let similarity = similarities[i - 1][j - 1]
+      if similarity >= cutoff:
+        best = max(best, scores[i - 1][j - 1] + similarity)
+      scores[i][j] = best
+  var i = aCount
+  var j = bCount
+  while i > 0 and j > 0:
+    if scores[i][j] == scores[i - 1][j]:
+      dec i
+    elif scores[i][j] == scores[i][j - 1]:
+      dec j
+    else:
+      result.add((i - 1, j - 1))
+      dec i
+      dec j
+  result.reverse()
+
+iterator unifiedDiff*(a, b: seq[string]; fromFile = "a", toFile = "b",
+                      context = 3, alignColumns = false,
+                      isJunk: proc(x: string): bool = nil,
+                      emptyMessage = "",
+                      ignoreLine: proc(line: string): bool = nil): string =
+  ## Yields the lines of a unified diff (as produced by ``diff -u``) that
+  ## converts the lines in ``a`` into the lines in ``b``, with up to
+  ## ``context`` lines of context around each change. If the lines are
+  ## the same, nothing is yielded, unless ``emptyMessage`` is given
+  ## (e.g., ``"Files are identical"``), in which case it is yielded as
+  ## the only line, with a ``"\n"`` added if it doesn't end with one.
+  ##
+  ## The lines are expected to include their terminating ``"\n"``, e.g.,
+  ## as returned by ``splitLinesKeepEnds()``, and every yielded line ends
+  ## with ``"\n"``. A line without a terminating ``"\n"`` (i.e., the last
+  ## line of a text that doesn't end with one) is followed by the
+  ## ``"\ No newline at end of file"`` marker, as ``diff`` and ``patch``
+  ## expect.
+  ##
+  ## If ``alignColumns`` is ``true``, then within each hunk, if every line
+  ## has the same number (at least two) of whitespace-separated fields,
+  ## the fields are padded so that they line up, e.g., to make the
+  ## changed values in ``key = value`` lines easier to compare. Hunks
+  ## whose lines have differing numbers of fields are output as normal.
+  ## Since aligning changes the lines' whitespace, the output is for
+  ## viewing rather than for use with ``patch``.
+  ##
+  ## If ``isJunk`` is given it is used for the diff (see ``newDiff()``).
+  ##
+  ## If ``ignoreLine`` is given (like ``diff -I``), any hunk whose changed
+  ## lines (i.e., those deleted or inserted, which include their ``"\n"``)
+  ## are all ones for which it returns ``true`` is omitted, e.g., to
+  ## ignore changed timestamps using the ``re`` module with
+  ## ``ignoreLine = (line: string) => line.contains(re"^# Generated")``.
+  ## Hunks with any other changed lines are output in full, and the line
+  ## numbers of all the hunks are unaffected.
+  let diff = newDiff(a, b, isJunk = isJunk)
+  for line in unifiedLines(diff, formatString, fromFile, toFile, context,
+                           markMissingNewline = true,
+                           alignColumns = alignColumns,
+                           emptyMessage = emptyMessage,
+                           ignore = ignoreLine):
+    yield line
+
+iterator unifiedDiff*[T](a, b: seq[T], format: proc(item: T): string;
+                         fromFile = "a", toFile = "b", context = 3,
+                         isJunk: proc(x: T): bool = nil,
+                         emptyMessage = ""): string =
+  ## Yields the lines of a unified diff that converts the items in ``a``
+  ## into the items in ``b``, using ``format`` to produce each item's
+  ## text, e.g., ``formatString``, ``formatDollar[T]``, or a custom proc
+  ## (say, to make control characters visible). If the items are the
+  ## same, only the ``emptyMessage`` line is yielded, or nothing if it is
+  ## empty (the default).
+  ##
+  ## Every yielded line ends with ``"\n"``, which is added to any item's
+  ## text that doesn't end with one. (So unlike ``unifiedDiff(a, b)``, no
+  ## "No newline at end of file" markers are yielded.)
+  ##
+  ## If ``isJunk`` is given it is used for the diff (see ``newDiff()``).
+  let diff = newDiff(a, b, isJunk = isJunk)
+  for line in unifiedLines(diff, format, fromFile, toFile, context,
+                           markMissingNewline = false,
+                           alignColumns = false,
+                           emptyMessage = emptyMessage, ignore = nil):
+    yield line
+
+proc diffText*(a, b: string; context = 3, normalizeEol = false,
+               showHidden = false, emptyMessage = ""): seq[string] =
+  ## Diffs the lines of the ``a`` and ``b`` texts and returns the lines of
+  ## a unified diff without the ``---`` and ``+++`` file headers and
+  ## without terminating ``"\n"``s, ready to be printed, e.g., with
+  ## ``echo(diffText(a, b).join("\n"))``. If the texts are the same,
+  ## returns an empty sequence, or ``@[emptyMessage]`` if
+  ## ``emptyMessage`` isn't empty.
+  ##
+  ## If ``normalizeEol`` is ``true``, both texts' line endings are
+  ## normalized (see ``normalizedEol()``) first, so texts whose only
+  ## differences are line endings (see ``onlyEolDiffers()``) are treated
+  ## as the same.
+  ##
+  ## If ``showHidden`` is ``true`` and there are differences, the lines
+  ## are preceded by an ``"(N lines above)"`` line if any unchanged lines
+  ## of ``a`` before the first hunk are hidden, and followed by an
+  ## ``"(N lines below)"`` line if any after the last hunk are hidden
+  ## (see ``hiddenLines()``); this is useful for navigation.
+  ##
+  ## For more control use ``unifiedDiff()`` or ``spans()``.
+  let textA = if normalizeEol: normalizedEol(a) else: a
+  let textB = if normalizeEol: normalizedEol(b) else: b
+  let linesA = splitLinesKeepEnds(textA)
+  let linesB = splitLinesKeepEnds(textB)
+  var skip = 2 # file headers
+  for line in unifiedDiff(linesA, linesB, context = context):
+    if skip > 0:
+      dec skip
+    else:
+      result.add(line[0 .. ^2])
+  if len(result) == 0 and emptyMessage != "":
+    return @[emptyMessage]
+  if showHidden and len(result) > 0:
+    let (above, below) = newDiff(linesA, linesB).hiddenLines(context)
+    if above > 0:
+      result.insert(&"({above} {plural(above)} above)", 0)
+    if below > 0:
+      result.add(&"({below} {plural(below)} below)")
+
+proc plural(count: int): string =
+  if count == 1: "line" else: "lines"
+
+proc formatString*(item: string): string =
+  ## Returns the ``item`` unchanged: for formatting strings.
+  item
+
+proc formatDollar*[T](item: T): string =
+  ## Returns ``$item``: for formatting items that support ``$``.
+  $item
+
+iterator unifiedLines[T](diff: Diff[T], format: proc(item: T): string,
+                         fromFile, toFile: string, context: int,
+                         markMissingNewline, alignColumns: bool,
+                         emptyMessage: string,
+                         ignore: proc(x: T): bool): string =
+  var started = false
+  for group in diff.groupedSpans(context):
+    if ignore != nil and diff.onlyIgnored(group, ignore):
+      continue
+    if not started:
+      started = true
+      yield &"--- {fromFile}\n"
+      yield &"+++ {toFile}\n"
+    let first = group[0]
+    let last = group[^1]
+    yield &"@@ -{unifiedRange(first.aStart, last.aEnd)} " &
+      &"+{unifiedRange(first.bStart, last.bEnd)} @@\n"
+    var lines = newSeq[string]()
+    for span in group:
+      if span.tag == tagEqual:
+        lines.addUnifiedLines(" ", diff.a[span.aStart ..< span.aEnd],
+                              format, markMissingNewline)
+      else:
+        lines.addUnifiedLines("-", diff.a[span.aStart ..< span.aEnd],
+                              format, markMissingNewline)
+        lines.addUnifiedLines("+", diff.b[span.bStart ..< span.bEnd],
+                              format, markMissingNewline)
+    if alignColumns:
+      lines = alignedColumns(lines)
+    for line in lines:
+      yield line
+  if not started and emptyMessage != "":
+    yield (if emptyMessage.endsWith('\n'): emptyMessage
+           else: emptyMessage & "\n")
+
+proc onlyIgnored[T](diff: Diff[T], group: seq[Span],
+                    ignore: proc(x: T): bool): bool =
+  for span in group:
+    if span.tag != tagEqual and
+        not (diff.a[span.aStart ..< span.aEnd].allIt(ignore(it)) and
+             diff.b[span.bStart ..< span.bEnd].allIt(ignore(it))):
+      return false
+  true
+
+proc alignedColumns(lines: seq[string]): seq[string] =
+  # Returns the unified diff lines with their fields padded to line up if
+  # they all have the same number of fields; otherwise returns them as is
+  var rows = newSeq[seq[string]]()
+  var widths = newSeq[int]()
+  for line in lines:
+    if line.startsWith('\\'): # No newline at end of file
+      continue
+    let fields = line[1 .. ^1].splitWhitespace()
+    if len(fields) < 2 or (len(rows) > 0 and len(fields) != len(widths)):
+      return lines
+    if len(rows) == 0:
+      widths = newSeq[int](len(fields))
+    for (i, field) in fields.pairs():
+      widths[i] = max(widths[i], displayWidth(field))
+    rows.add(fields)
+  var row = 0
+  for line in lines:
+    if line.startsWith('\\'):
+      result.add(line)
+      continue
+    var text = $line[0]
+    for (i, field) in rows[row].pairs():
+      text.add(field)
+      if i < len(widths) - 1:
+        text.add(spaces(widths[i] - displayWidth(field) + 1))
+    result.add(text & "\n")
+    inc row
+
+proc unifiedRange(start, finish: int): string =
+  let length = finish - start
+  if length == 1:
+    $(start + 1)
+  elif length == 0:
+    &"{start},0"
+  else:
+    &"{start + 1},{length}"
+
+proc addUnifiedLines[T](lines: var seq[string], prefix: string,
+                        items: seq[T], format: proc(item: T): string,
+                        markMissingNewline: bool) =
+  for item in items:
+    let text = format(item)
+    if text.endsWith('\n'):
+      lines.add(prefix & text)
+    else:
+      lines.add(prefix & text & "\n")
+      if markMissingNewline:
+        lines.add("\\ No newline at end of file\n")
+
+proc writeFormatted*[T](diff: Diff[T], stream: Stream,
+                        formatter: Formatter[T]) =
+  ## Writes the diff to the ``stream`` using the given ``formatter``,
+  ## which may be one of the provided formatters, ``unifiedFormatter()``,
+  ## ``jsonFormatter()``, or ``dotFormatter()``, or a custom one, so that
+  ## output formats can be chosen or registered at runtime.
+  formatter(stream, diff)
+
+proc unifiedFormatter*(fromFile = "a", toFile = "b", context = 3,
+                       emptyMessage = ""): Formatter[string] =
+  ## Returns a ``Formatter`` that writes a unified diff of the lines (see
+  ## ``unifiedDiff()``, including for ``emptyMessage``), using the given
+  ## ``Diff`` itself, so with whatever options it was created with.
+  result = proc(stream: Stream, diff: Diff[string]) =
+    for line in unifiedLines(diff, formatString, fromFile, toFile,
+                             context, markMissingNewline = true,
+                             alignColumns = false,
+                             emptyMessage = emptyMessage, ignore = nil):
+      stream.write(line)
+
+proc jsonFormatter*(context = 3): Formatter[string] =
+  ## Returns a ``Formatter`` that writes the hunks as JSON (see
+  ## ``writeJsonHunks()``).
+  result = proc(stream: Stream, diff: Diff[string]) =
+    diff.writeJsonHunks(stream, context)
+
+proc dotFormatter*[T](): Formatter[T] =
+  ## Returns a ``Formatter`` that writes a Graphviz DOT graph of the
+  ## alignment (see ``writeDot()``).
+  result = proc(stream: Stream, diff: Diff[T]) =
+    diff.writeDot(stream)
+
+proc writeDot*[T](diff: Diff[T], stream: Stream) =
+  ## Writes the diff's alignment to the ``stream`` as a Graphviz DOT
+  ## graph, with a node for each index in ``a`` (``a0``, ``a1``, ...) and
+  ## in ``b`` (``b0``, ...), and an edge joining each pair of aligned
+  ## items, i.e., the items of each match. This is for inspecting
+  ## surprising diffs, e.g., with ``dot -Tsvg``.
+  stream.write("digraph diff {\n  rankdir=LR;\n")
+  for (name, length) in [("a", len(diff.a)), ("b", len(diff.b))]:
+    stream.write(&"  subgraph cluster_{name} {{\n    label=\"{name}\";\n")
+    for i in 0 ..< length:
+      stream.write(&"    {name}{i} [label=\"{i}\"];\n")
+    stream.write("  }\n")
+  for match in diff.matches(withSentinel = false):
+    for k in 0 ..< match.length:
+      stream.write(&"  a{match.aStart + k} -> b{match.bStart + k};\n")
+  stream.write("}\n")
+
+proc writeJsonHunks*(diff: Diff[string], stream: Stream, context = 3) =
+  ## Writes the diff's hunks (see ``hunks()``) to the ``stream`` as
+  ## a JSON array of hunk objects, e.g., for a web-based diff viewer.
+  ## Each hunk object has ``aStart``, ``aCount``, ``bStart``, and
+  ## ``bCount`` fields with 1-based line numbers as in the hunk's
+  ## ``@@ -aStart,aCount +bStart,bCount @@`` unified diff header, and a
+  ## ``lines`` array of line objects, each with a
+  ## ``tag`` field (``"equal"``, ``"delete"``, or ``"insert"``; a
+  ## replacement's lines are deleted and then inserted) and a ``content``
+  ## field with the line itself. An identical pair gives ``[]``.
+  let jsonHunks = newJArray()
+  for (header, spans) in diff.hunks(context):
+    let lines = newJArray()
+    for span in spans:
+      if span.tag == tagEqual:
+        lines.addJsonLines(tagEqual, diff.a[span.aStart ..< span.aEnd])
+      else:
+        lines.addJsonLines(tagDelete, diff.a[span.aStart ..< span.aEnd])
+        lines.addJsonLines(tagInsert, diff.b[span.bStart ..< span.bEnd])
+    jsonHunks.add(%*{"aStart": header.aStart, "aCount": header.aCount,
+                     "bStart": header.bStart, "bCount": header.bCount,
+                     "lines": lines})
+  stream.write($jsonHunks)
+
+proc addJsonLines(lines: JsonNode, tag: Tag, items: seq[string]) =
+  for item in items:
+    lines.add(%*{"tag": $tag, "content": item})
+
+proc edits*[T](diff: Diff[T]): seq[Edit[T]] =
+  ## Returns an ``Edit`` for each change, in ``a`` order, each saying to
+  ## replace ``a[aStart ..< aEnd]`` with ``newItems`` (an empty range for
+  ## an insertion, and no items for a deletion). Applying the edits to
+  ## ``a`` in reverse order (so earlier edits' positions aren't affected
+  ## by later ones) produces ``b``.
+  for span in diff.spans(skipEqual = true):
+    result.add((span.aStart, span.aEnd, diff.b[span.bStart ..< span.bEnd]))
+
+proc toPatch*[T](diff: Diff[T]): Patch[T] =
+  ## Returns a ``Patch`` that can be applied to ``a`` (see ``apply()``) to
+  ## produce ``b``. Each span's items are the ``b`` items for
+  ## ``tagInsert`` and ``tagReplace`` spans and empty for the others, so
+  ## the patch doesn't need ``b`` itself.
+  for span in diff.spans():
+    var items = newSeq[T]()
+    if span.tag == tagInsert or span.tag == tagReplace:
+      items = diff.b[span.bStart ..< span.bEnd]
+    result.add((span, items))
+
+proc apply*[T](a: seq[T], patch: Patch[T]): seq[T] =
+  ## Returns the sequence produced by applying the ``patch`` to ``a``.
+  ##
+  ## Raises ``PatchError`` (with the ``index`` of the first invalid span)
+  ## if the patch's spans don't cover ``a`` exactly, i.e., if they aren't
+  ## in order, have gaps or overlaps, or are out of ``a``'s range, e.g.,
+  ## if the patch is corrupt or is for a different ``a``. It is also
+  ## raised if a span's shape doesn't fit its tag, e.g., a ``tagInsert``
+  ## span that covers items of ``a``, or a span with the wrong number of
+  ## items (which must be none for ``tagEqual`` and ``tagDelete`` spans,
+  ## and ``bEnd - bStart`` for the others).
+  validatePatch(len(a), patch)
+  for (span, items) in patch:
+    case span.tag
+    of tagEqual: result.add(a[span.aStart ..< span.aEnd])
+    of tagDelete: discard
+    of tagInsert, tagReplace: result.add(items)
+
+proc validatePatch[T](aLen: int, patch: Patch[T]) =
+  var start = 0
+  for (index, item) in patch.pairs():
+    let span = item.span
+    if span.aStart < 0 or span.aEnd < span.aStart or span.aEnd > aLen:
+      raisePatchError(index, &"out of range {span.aStart}..<{span.aEnd}")
+    validatePatchItem(index, item)
+    if index > 0 and span.aStart < patch[index - 1].span.aStart:
+      raisePatchError(index, "not in order")
+    if span.aStart < start:
+      raisePatchError(index, &"overlaps at {span.aStart}")
+    if span.aStart > start:
+      raisePatchError(index, &"gap at {start}")
+    start = span.aEnd
+  if start < aLen:
+    raisePatchError(len(patch), &"gap at {start}")
+
+proc validatePatchItem[T](index: int, item: PatchItem[T]) =
+  let span = item.span
+  if span.bStart < 0 or span.bEnd < span.bStart:
+    raisePatchError(index, &"out of range {span.bStart}..<{span.bEnd} " &
+                    "in b")
+  let aCount = span.aEnd - span.aStart
+  let bCount = span.bEnd - span.bStart
+  case span.tag
+  of tagEqual:
+    if aCount != bCount:
+      raisePatchError(index, "equal span with unequal ranges")
+  of tagInsert:
+    if aCount > 0:
+      raisePatchError(index, "insert span with items of a")
+  of tagDelete:
+    if bCount > 0:
+      raisePatchError(index, "delete span with items of b")
+  of tagReplace: discard
+  let expected = if span.tag in {tagEqual, tagDelete}: 0 else: bCount
+  if len(item.items) != expected:
+    raisePatchError(index, &"{span.tag} has {len(item.items)} items " &
+                    &"instead of {expected}")
+
+proc raisePatchError(index: int, reason: string) =
+  var error = newException(PatchError, &"invalid patch span {index}: " &
+                           reason)
+  error.index = index
+  raise error
+
+proc applySlices*[T](slices: seq[SpanSlice[T]]): seq[T] =
+  ## Returns ``b`` reconstructed from all the span slices that convert
+  ## ``a`` into ``b`` (e.g., from ``spanSlices()``), without needing
+  ## ``a`` or ``b`` themselves. This works because every ``tagEqual``,
+  ## ``tagInsert``, and ``tagReplace`` slice holds its ``b`` items (and
+  ## ``tagDelete`` slices, whose ``b`` is empty, contribute nothing); so
+  ## the slices must include the ``tagEqual`` ones (i.e., mustn't have
+  ## been produced with ``skipEqual``).
+  for slice in slices:
+    result.add(slice.b)
+
+proc coalesceSlices*[T](slices: seq[SpanSlice[T]]): seq[SpanSlice[T]] =
+  ## Returns the ``slices`` with every run of consecutive slices that have
+  ## the same tag merged into a single slice holding all their items.
+  ## Slices with different tags are never merged. This is useful after
+  ## transforming slices, e.g., after using ``skipEqual`` and
+  ## ``noReplace`` there may be consecutive ``tagDelete`` slices.
+  for slice in slices:
+    if len(result) > 0 and result[^1].tag == slice.tag:
+      result[^1].a.add(slice.a)
+      result[^1].b.add(slice.b)
+    else:
+      result.add(slice)
+
+proc compactSlices*[T](slices: seq[SpanSlice[T]]): seq[SpanSlice[T]] =
+  ## Returns the ``slices`` without any that have no items for their tag:
+  ## ``tagEqual`` and ``tagDelete`` slices with an empty ``a``,
+  ## ``tagInsert`` slices with an empty ``b``, and ``tagReplace`` slices
+  ## with both empty.
+  ##
+  ## The slices produced by ``spanSlices()`` are never empty in this
+  ## sense, since the spans never are (zero-length matches, such as the
+  ## sentinel, don't produce spans). But slices that are constructed,
+  ## received, or transformed (e.g., by taking the items within a window)
+  ## may be, and this saves every renderer from having to check.
+  for slice in slices:
+    let empty = case slice.tag
+      of tagEqual, tagDelete: len(slice.a) == 0
+      of tagInsert: len(slice.b) == 0
+      of tagReplace: len(slice.a) == 0 and len(slice.b) == 0
+    if not empty:
+      result.add(slice)
+
+proc writePatch*[T](diff: Diff[T], stream: Stream,
+                    encode: proc(stream: Stream, item: T)) =
+  ## Writes the diff's patch (see ``toPatch()``) to the ``stream`` in a
+  ## compact binary format, using ``encode`` to write each item. (For
+  ## strings use ``encodeString``.)
+  ##
+  ## The format is the bytes ``"DIFP"``, a version byte (1), the number
+  ## of spans, and then for each span its tag byte, its ``aStart``,
+  ## ``aEnd``, ``bStart``, and ``bEnd``, the number of its items, and the
+  ## items themselves. Numbers are written as unsigned LEB128 varints.
+  let patch = diff.toPatch()
+  stream.write("DIFP")
+  stream.write(uint8(1))
+  stream.writeVarint(len(patch))
+  for (span, items) in patch:
+    stream.write(uint8(ord(span.tag)))
+    stream.writeVarint(span.aStart)
+    stream.writeVarint(span.aEnd)
+    stream.writeVarint(span.bStart)
+    stream.writeVarint(span.bEnd)
+    stream.writeVarint(len(items))
+    for item in items:
+      encode(stream, item)
+
+proc readPatch*[T](stream: Stream, decode: proc(stream: Stream): T):
+    Patch[T] =
+  ## Reads and returns a patch written by ``writePatch()``, using
+  ## ``decode`` to read each item. (For strings use ``decodeString``.)
+  ##
+  ## Raises ``ValueError`` if the stream doesn't hold a valid patch,
+  ## including if it is truncated, or ``PatchError`` (see ``apply()``) if
+  ## a span's shape doesn't fit its tag.
+  try:
+    if stream.readStr(4) != "DIFP" or stream.readUint8() != 1:
+      raise newException(ValueError, "not a version 1 diff patch")
+    let count = stream.readVarint()
+    for i in 0 ..< count:
+      let tagValue = int(stream.readUint8())
+      if tagValue > ord(high(Tag)):
+        raise newException(ValueError, &"invalid tag {tagValue} in patch")
+      let tag = Tag(tagValue)
+      let aStart = stream.readVarint()
+      let aEnd = stream.readVarint()
+      let bStart = stream.readVarint()
+      let bEnd = stream.readVarint()
+      var items = newSeq[T]()
+      for j in 0 ..< stream.readVarint():
+        items.add(decode(stream))
+      let span = newSpan(tag, aStart, aEnd, bStart, bEnd)
+      let item: PatchItem[T] = (span, items)
+      validatePatchItem(i, item)
+      result.add(item)
+  except IOError as error:
+    raise newException(ValueError, "truncated diff patch: " & error.msg)
+
+proc encodeString*(stream: Stream, item: string) =
+  ## Writes a string for ``writePatch()``.
+  stream.writeVarint(len(item))
+  stream.write(item)
+
+proc decodeString*(stream: Stream): string =
+  ## Reads a string for ``readPatch()``. Raises ``ValueError`` if the
+  ## stream ends before the whole string has been read.
+  let size = stream.readVarint()
+  # Read in chunks so that a corrupt size can't cause a huge allocation
+  while len(result) < size:
+    let chunk = stream.readStr(min(65536, size - len(result)))
+    if len(chunk) == 0:
+      raise newException(ValueError, "truncated string in diff patch")
+    result.add(chunk)
+
+proc writeVarint(stream: Stream, value: int) =
+  var value = value
+  while value >= 0x80:
+    stream.write(uint8((value and 0x7F) or 0x80))
+    value = value shr 7
+  stream.write(uint8(value))
+
+proc readVarint(stream: Stream): int =
+  var shift = 0
+  while true:
+    if shift > 56:
+      raise newException(ValueError, "invalid number in diff patch")
+    let octet = int(stream.readUint8())
+    result = result or ((octet and 0x7F) shl shift)
+    if (octet and 0x80) == 0:
+      break
+    shift += 7
+
+proc minimalizeEdits*[T](diff: Diff[T]): seq[Span] =
+  ## Returns the diff's spans with any redundant replacements rewritten
+  ## as shorter edits (see ``minimalizeEdits(a, b, spans)``).
+  minimalizeEdits(diff.a, diff.b, toSeq(diff.spans()))
+
+proc minimalizeEdits*[T](a, b: seq[T], spans: seq[Span]): seq[Span] =
+  ## Returns the given contiguous ``spans`` of ``a`` and ``b`` with any
+  ## ``tagReplace`` span where one side's items are a prefix or suffix of
+  ## the other side's items rewritten as a ``tagEqual`` span plus a
+  ## ``tagInsert`` or ``tagDelete`` span (merging adjacent ``tagEqual``
+  ## spans). This reduces the number of edited items; unlike a semantic
+  ## cleanup, it doesn't aim to improve readability.
+  var rewritten = newSeq[Span]()
+  for span in spans:
+    if span.tag != tagReplace:
+      rewritten.add(span)
+      continue
+    let aItems = a[span.aStart ..< span.aEnd]
+    let bItems = b[span.bStart ..< span.bEnd]
+    let aLen = len(aItems)
+    let bLen = len(bItems)
+    if bLen > aLen and bItems[0 ..< aLen] == aItems:
+      rewritten.add(newSpan(tagEqual, span.aStart, span.aEnd, span.bStart,
+                            span.bStart + aLen))
+      rewritten.add(newSpan(tagInsert, span.aEnd, span.aEnd,
+                            span.bStart + aLen, span.bEnd))
+    elif bLen > aLen and bItems[bLen - aLen .. ^1] == aItems:
+      rewritten.add(newSpan(tagInsert, span.aStart, span.aStart,
+                            span.bStart, span.bEnd - aLen))
+      rewritten.add(newSpan(tagEqual, span.aStart, span.aEnd,
+                            span.bEnd - aLen, span.bEnd))
+    elif aLen > bLen and aItems[0 ..< bLen] == bItems:
+      rewritten.add(newSpan(tagEqual, span.aStart, span.aStart + bLen,
+                            span.bStart, span.bEnd))
+      rewritten.add(newSpan(tagDelete, span.aStart + bLen, span.aEnd,
+                            span.bEnd, span.bEnd))
+    elif aLen > bLen and aItems[aLen - bLen .. ^1] == bItems:
+      rewritten.add(newSpan(tagDelete, span.aStart, span.aEnd - bLen,
+                            span.bStart, span.bStart))
+      rewritten.add(newSpan(tagEqual, span.aEnd - bLen, span.aEnd,
+                            span.bStart, span.bEnd))
+    else:
+      rewritten.add(span)
+  for span in rewritten:
+    if len(result) > 0 and span.tag == tagEqual and
+        result[^1].tag == tagEqual:
+      result[^1].aEnd = span.aEnd
+      result[^1].bEnd = span.bEnd
+    else:
+      result.add(span)
+
+proc replacePair*[T](slice: SpanSlice[T]):
+    tuple[before, after: seq[T], ok: bool] =
+  ## Returns the "before" (from ``a``) and "after" (from ``b``) items of a
+  ## ``tagReplace`` slice with ``ok`` set to ``true``; or empty sequences
+  ## and ``false`` for any other tag. For example, with ``diffRows()``
+  ## this gives the old and new versions of each changed record.
+  if slice.tag == tagReplace:
+    result = (slice.a, slice.b, true)
+
+proc fieldChanges*[T, V](before, after: T,
+                         fields: proc(item: T): OrderedTable[string, V]):
+    OrderedTable[string, tuple[before, after: V]] =
+  ## Returns the ``(before, after)`` values of every field that differs
+  ## between ``before`` and ``after``, e.g., a pair of records from
+  ## ``replacePair()``. The ``fields`` proc must return a record's field
+  ## values keyed by field name. Changes are in ``before``'s field order
+  ## followed by any fields only in ``after``; a field missing on one
+  ## side has ``default(V)`` as its value.
+  let beforeFields = fields(before)
+  let afterFields = fields(after)
+  for (name, value) in beforeFields.pairs():
+    let newValue = afterFields.getOrDefault(name)
+    if not afterFields.hasKey(name) or newValue != value:
+      result[name] = (value, newValue)
+  for (name, value) in afterFields.pairs():
+    if not beforeFields.hasKey(name):
+      result[name] = (default(V), value)
+
+proc merge3*[T](base, mine, theirs: seq[T]):
+    tuple[merged: seq[T], conflicts: seq[Conflict[T]]] =
+  ## Returns the three-way merge of the changes from ``base`` to ``mine``
+  ## and from ``base`` to ``theirs`` (see ``merge3(mine, theirs)``).
+  merge3(newDiff(base, mine), newDiff(base, theirs))
+
+proc merge3*[T](mine, theirs: Diff[T]):
+    tuple[merged: seq[T], conflicts: seq[Conflict[T]]] =
+  ## Returns the three-way merge of the changes of two diffs of the same
+  ## base (i.e., with equal ``a``s), e.g., as made by two people editing
+  ## the same file. The given diffs are used as they are, so they may
+  ## have been created with any options and their matches may already
+  ## have been computed. Raises ``ValueError`` if their ``a``s differ.
+  ##
+  ## Changes to separate parts of the base are applied to produce the
+  ## ``merged`` result, as are identical changes made by both. But where
+  ## both diffs change overlapping or adjacent parts of the base
+  ## differently, there is a conflict: neither change is applied, and a
+  ## ``Conflict`` is added to ``conflicts`` with the ``index`` in
+  ## ``merged`` where the resolution belongs, and the ``base``, ``mine``,
+  ## and ``theirs`` versions of the conflicting items, e.g., for writing
+  ## them between ``<<<<<<<``, ``=======``, and ``>>>>>>>`` markers.
+  if mine.a != theirs.a:
+    raise newException(ValueError, "the diffs have different bases")
+  let base = mine.a
+  var changes = newSeq[tuple[span: Span, isTheirs: bool]]()
+  for span in mine.spans(skipEqual = true):
+    changes.add((span, false))
+  for span in theirs.spans(skipEqual = true):
+    changes.add((span, true))
+  changes.sort((x, y) => cmp(x.span.aStart, y.span.aStart)) # stable
+  var position = 0
+  var i = 0
+  while i < len(changes):
+    let aStart = changes[i].span.aStart
+    var aEnd = changes[i].span.aEnd
+    var j = i + 1
+    while j < len(changes) and changes[j].span.aStart <= aEnd:
+      aEnd = max(aEnd, changes[j].span.aEnd)
+      inc j
+    result.merged.add(base[position ..< aStart])
+    let group = changes[i ..< j]
+    let (mineChanged, mineItems) = sideItems(mine, group, false, aStart,
+                                             aEnd)
+    let (theirsChanged, theirsItems) = sideItems(theirs, group, true,
+                                                 aStart, aEnd)
+    if not mineChanged or mineItems == theirsItems:
+      result.merged.add(theirsItems)
+    elif not theirsChanged:
+      result.merged.add(mineItems)
+    else:
+      result.conflicts.add((len(result.merged), base[aStart ..< aEnd],
+                            mineItems, theirsItems))
+    position = aEnd
+    i = j
+  result.merged.add(base[position .. ^1])
+
+proc sideItems[T](diff: Diff[T],
+                  group: seq[tuple[span: Span, isTheirs: bool]],
+                  isTheirs: bool, aStart, aEnd: int):
+    tuple[changed: bool, items: seq[T]] =
+  # Returns whether the diff changes any of base[aStart ..< aEnd], and the
+  # items it replaces them with (or the base items if it doesn't)
+  let spans = group.filterIt(it.isTheirs == isTheirs).mapIt(it.span)
+  if len(spans) == 0:
+    return (false, diff.a[aStart ..< aEnd])
+  let bStart = spans[0].bStart - (spans[0].aStart - aStart)
+  let bEnd = spans[^1].bEnd + (aEnd - spans[^1].aEnd)
+  (true, diff.b[bStart ..< bEnd])
+
+proc diffRecords*[T, K, V](a, b: seq[T], key: proc(item: T): K,
+                           fields: proc(item: T): OrderedTable[string, V]):
+    RecordChanges[K, V] =
+  ## Returns what changed between two sequences of records, e.g., two
+  ## versions of a dataset: the ``added`` keys (in ``b``'s order), the
+  ## ``removed`` keys (in ``a``'s order), and for every record that is in
+  ## both but differs, its key and the ``(before, after)`` values of the
+  ## fields that differ (see ``fieldChanges()``), in ``a``'s order.
+  ##
+  ## The records are matched by their keys (see ``newKeyDiff()``, but
+  ## without ``autoJunk``), so records with duplicate keys are matched in
+  ## order of occurrence where possible, and any unmatched duplicates are
+  ## reported as added or removed (so the same key may be in more than
+  ## one of the results).
+  let diff = newDiff(a.map(key), b.map(key), autoJunk = false)
+  for span in diff.spans():
+    case span.tag
+    of tagEqual:
+      for offset in 0 ..< span.aEnd - span.aStart:
+        let changes = fieldChanges(a[span.aStart + offset],
+                                   b[span.bStart + offset], fields)
+        if len(changes) > 0:
+          result.changed.add((diff.a[span.aStart + offset], changes))
+    of tagInsert, tagDelete, tagReplace:
+      result.removed.add(diff.a[span.aStart ..< span.aEnd])
+      result.added.add(diff.b[span.bStart ..< span.bEnd])
+
+proc setDiff*[T](a, b: seq[T]): tuple[onlyA, onlyB, both: seq[T]] =
+  ## Compares ``a`` and ``b`` as unordered collections (for which a
+  ## sequence diff would be misleading), and returns the items that are
+  ## only in ``a`` (i.e., deleted), only in ``b`` (i.e., inserted), and in
+  ## both (i.e., equal), each in ascending order. The items must support
+  ## ``<`` and ``==``.
+  ##
+  ## Duplicates are compared as multisets, i.e., an item that occurs m
+  ## times in ``a`` and n times in ``b`` is in ``both`` min(m, n) times,
+  ## and in ``onlyA`` or ``onlyB`` for the rest.
+  let a = sorted(a)
+  let b = sorted(b)
+  var i = 0
+  var j = 0
+  while i < len(a) and j < len(b):
+    if a[i] < b[j]:
+      result.onlyA.add(a[i])
+      inc i
+    elif b[j] < a[i]:
+      result.onlyB.add(b[j])
+      inc j
+    else:
+      result.both.add(a[i])
+      inc i
+      inc j
+  result.onlyA.add(a[i .. ^1])
+  result.onlyB.add(b[j .. ^1])
+
+proc newSequenceMatcher*[T](a, b: seq[T]; autoJunk = true):
+    SequenceMatcher[T] =
+  ## Creates a new ``SequenceMatcher``, i.e., a ``Diff``, for those porting
+  ## code that uses Python's ``SequenceMatcher(None, a, b)``. Use it with
+  ## ``ratio()``, ``getOpcodes()``, and ``getMatchingBlocks()``. Like
+  ## difflib, it treats popular items as junk when ``b`` has 200 or more
+  ## items (i.e., it uses an ``autoJunkMin`` of 199).
+  newDiff(a, b, autoJunk = autoJunk, autoJunkMin = 199)
+
+proc getOpcodes*[T](diff: Diff[T]): seq[Opcode] =
+  ## Returns the diff's spans as difflib-style opcodes, i.e., with tags of
+  ## ``"equal"``, ``"insert"``, ``"delete"``, or ``"replace"``.
+  for span in diff.spans():
+    result.add((tag: $span.tag, i1: span.aStart, i2: span.aEnd,
+                j1: span.bStart, j2: span.bEnd))
+
+proc getMatchingBlocks*[T](diff: Diff[T]): seq[Match] =
+  ## Returns the diff's matches including the final zero-length sentinel
+  ## (as difflib does); this is the same as ``matches()``.
+  diff.matches()
+
+proc absorbEqualGaps*[T](diff: Diff[T], maxEqualGap: int): seq[Span] =
+  ## Returns the diff's spans with short equal gaps between changes
+  ## absorbed (see ``absorbEqualGaps(spans, maxEqualGap)``).
+  absorbEqualGaps(toSeq(diff.spans()), maxEqualGap)
+
+proc absorbEqualGaps*(spans: seq[Span], maxEqualGap: int): seq[Span] =
+  ## Returns the given contiguous ``spans`` with every ``tagEqual`` span
+  ## of at most ``maxEqualGap`` items that lies between two changes
+  ## merged with them into a single change. For example, with a
+  ## ``maxEqualGap`` of 1, a change that is interrupted by a single
+  ## coincidentally equal item (such as a punctuation token) becomes one
+  ## change rather than two.
+  ##
+  ## The merged span's tag reflects its ranges, so since an absorbed gap
+  ## has items in both ``a`` and ``b``, it is always a ``tagReplace``.
+  ## This trades edit minimality (the absorbed items count as changed)
+  ## for readability.
+  var i = 0
+  while i < len(spans):
+    let span = spans[i]
+    if span.tag == tagEqual and span.aEnd - span.aStart <= maxEqualGap and
+        len(result) > 0 and result[^1].tag != tagEqual and
+        i + 1 < len(spans) and spans[i + 1].tag != tagEqual:
+      let first = result[^1]
+      let last = spans[i + 1]
+      let tag = tagForRanges(first.aStart, last.aEnd, first.bStart,
+                             last.bEnd)
+      result[^1] = newSpan(tag, first.aStart, last.aEnd, first.bStart,
+                           last.bEnd)
+      i += 2
+    else:
+      result.add(span)
+      inc i
+
+proc minimizePatchBytes*[T](diff: Diff[T],
+                            encode: proc(spans: seq[Span]): int):
+    seq[Span] =
+  ## Returns the diff's spans adjusted to minimize the size of the
+  ## encoded patch (see ``minimizePatchBytes(spans, encode)``).
+  minimizePatchBytes(toSeq(diff.spans()), encode)
+
+proc minimizePatchBytes*(spans: seq[Span],
+                         encode: proc(spans: seq[Span]): int): seq[Span] =
+  ## Returns the given contiguous ``spans`` with changes that are
+  ## separated only by a ``tagEqual`` span merged into a single change
+  ## (with the equal items counted as changed), wherever doing so makes
+  ## the patch smaller as measured by ``encode``, which should return the
+  ## (possibly estimated) size in bytes of the patch for the spans it is
+  ## given.
+  ##
+  ## The fewest edits don't always give the smallest patch: if each
+  ## change has a fixed overhead (e.g., for its position), one change
+  ## covering a few unchanged items can encode smaller than two. This
+  ## is greedy: each possible merge is kept if it makes the patch
+  ## smaller than it was before, so it calls ``encode`` once per
+  ## ``tagEqual`` span between two changes, plus once more.
+  result = spans
+  var size = encode(result)
+  var i = 1
+  while i < len(result) - 1:
+    if result[i].tag == tagEqual and result[i - 1].tag != tagEqual and
+        result[i + 1].tag != tagEqual:
+      let first = result[i - 1]
+      let last = result[i + 1]
+      var candidate = result[0 ..< i - 1]
+      candidate.add(newSpan(tagForRanges(first.aStart, last.aEnd,
+                                         first.bStart, last.bEnd),
+                            first.aStart, last.aEnd, first.bStart,
+                            last.bEnd))
+      candidate.add(result[i + 2 .. ^1])
+      let candidateSize = encode(candidate)
+      if candidateSize < size:
+        result = candidate
+        size = candidateSize
+        continue # the merged change may merge with the next one too
+    inc i
+
+proc costSpans*[T](a, b: seq[T];
+                   insertCost, deleteCost: proc(item: T): int,
+                   substituteCost: proc(x, y: T): int): seq[Span] =
+  ## Returns the spans that convert ``a`` into ``b`` at the minimum total
+  ## cost, where inserting ``b``'s items, deleting ``a``'s items, and
+  ## substituting an ``a`` item with an unequal ``b`` item each cost what
+  ## the given procs return (equal items cost nothing). For example,
+  ## making deletion of a heading costlier than deletion of a blank line
+  ## favors alignments that keep the heading.
+  ##
+  ## Note that this doesn't use the ``Diff`` matching algorithm at all,
+  ## but rather a dynamic programming alignment that takes
+  ## ``O(len(a) * len(b))`` time and space, so the spans can differ from
+  ## those returned by ``spans()`` even when every cost is 1. Adjacent
+  ## insertions, deletions, and substitutions are returned as a single
+  ## span.
+  let aLen = len(a)
+  let bLen = len(b)
+  var costs = newSeqWith(aLen + 1, newSeq[int](bLen + 1))
+  for i in countdown(aLen, 0):
+    for j in countdown(bLen, 0):
+      if i == aLen and j == bLen:
+        continue
+      var best = high(int)
+      if i < aLen and j < bLen:
+        best = costs[i + 1][j + 1]
+        if a[i] != b[j]:
+          best += substituteCost(a[i], b[j])
+      if i < aLen:
+        best = min(best, costs[i + 1][j] + deleteCost(a[i]))
+      if j < bLen:
+        best = min(best, costs[i][j + 1] + insertCost(b[j]))
+      costs[i][j] = best
+  var i = 0
+  var j = 0
+  var aStart = 0
+  var bStart = 0
+  var equal = true
+  while i < aLen or j < bLen:
+    let both = i < aLen and j < bLen
+    let same = both and a[i] == b[j] and
+               costs[i][j] == costs[i + 1][j + 1]
+    var aStep = 0
+    var bStep = 0
+    if same or (both and a[i] != b[j] and costs[i][j] ==
+                costs[i + 1][j + 1] + substituteCost(a[i], b[j])):
+      aStep = 1
+      bStep = 1
+    elif i < aLen and costs[i][j] == costs[i + 1][j] + deleteCost(a[i]):
+      aStep = 1
+    else:
+      bStep = 1
+    if same != equal and (i > aStart or j > bStart):
+      let tag = if equal: tagEqual else: tagForRanges(aStart, i, bStart, j)
+      result.add(newSpan(tag, aStart, i, bStart, j))
+      aStart = i
+      bStart = j
+    equal = same
+    i += aStep
+    j += bStep
+  if i > aStart or j > bStart:
+    let tag = if equal: tagEqual else: tagForRanges(aStart, i, bStart, j)
+    result.add(newSpan(tag, aStart, i, bStart, j))
+
+proc tagForRanges(aStart, aEnd, bStart, bEnd: int): Tag =
+  if aStart < aEnd and bStart < bEnd:
+    tagReplace
+  elif aStart < aEnd:
+    tagDelete
+  elif bStart < bEnd:
+    tagInsert
+  else:
+    tagEqual
+
+proc versionInfo*(): tuple[major, minor, patch: int] =
+  ## Returns the components of the library's ``Version``, e.g., so that
+  ## features can be used depending on the version.
+  parseVersion(Version)
+
+proc parseVersion*(version: string): tuple[major, minor, patch: int] =
+  ## Returns the components of a ``"major.minor.patch"`` or
+  ## ``"major.minor"`` version string (in which case ``patch`` is 0).
+  ## Raises ``ValueError`` if ``version`` isn't of one of these forms.
+  let parts = version.split('.')
+  if len(parts) notin 2 .. 3:
+    raise newException(ValueError, &"invalid version: \"{version}\"")
+  var numbers = [0, 0, 0]
+  for (i, part) in parts.pairs():
+    if len(part) == 0 or not part.allCharsInSet(Digits):
+      raise newException(ValueError, &"invalid version: \"{version}\"")
+    numbers[i] = parseInt(part)
+  (numbers[0], numbers[1], numbers[2])
+
+proc isValid*(tag: Tag): bool =
+  ## Returns ``true`` if the ``tag`` is one of the ``Tags``, i.e., it
+  ## wasn't made from an out of range value (e.g., by a ``cast`` of a
+  ## corrupt value).
+  ord(tag) >= ord(low(Tag)) and ord(tag) <= ord(high(Tag))
+
+proc `$`*(tag: Tag): string =
+  ## Returns the tag's name, e.g., ``"equal"``, or for an invalid tag
+  ## (see ``isValid()``), ``"Tag(N)"`` where ``N`` is its value, so it
+  ## is always safe to use, e.g., for logging.
+  if tag.isValid(): system.`$`(tag) else: &"Tag({ord(tag)})"
 
 proc newMatch*(aStart, bStart, length: int): Match =
   ## Creates a new match: *only public for testing purposes*.
@@ -273,6 +2955,14 @@ proc newSpanSlice*[T](tag: Tag, a, b: seq[T]): SpanSlice[T] =
   result.a = a
   result.b = b
 
+proc newGridRow*(tag: Tag, aRow, bRow: int, cells: seq[Span] = @[]):
+    GridRow =
+  ## Creates a new grid row: *only public for testing purposes*.
+  result.tag = tag
+  result.aRow = aRow
+  result.bRow = bRow
+  result.cells = cells
+
 proc `==`*(a, b: Span): bool =
   ## Compares spans: *only public for testing purposes*.
   a.tag == b.tag and a.aStart == b.aStart and a.aEnd == b.aEnd and
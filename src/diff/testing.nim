@@ -0,0 +1,70 @@
+# Copyright © 2019-20 Mark Summerfield. All rights reserved.
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may only use this file in compliance with the License. The license
+# is available from http://www.apache.org/licenses/LICENSE-2.0
+
+## This module provides helpers for using diffs in ``unittest`` tests.
+## It is separate from the ``diff`` module so that using ``diff`` doesn't
+## depend on ``unittest``.
+##
+## Example:
+## ```nim
+## import diff/testing
+## import strutils
+## import unittest
+##
+## test "words":
+##   checkEqualSeqs(@["one", "two"], "one two".split())
+## ```
+
+import ../diff
+import strutils
+import unittest
+
+proc seqDiff*[T](want, got: seq[T]): string =
+  ## Returns a unified diff that converts ``want`` into ``got`` (using
+  ## ``$`` to format each item), or an empty string if they are the same.
+  for line in unifiedDiff(want, got, formatDollar[T], fromFile = "want",
+                          toFile = "got"):
+    result.add(line)
+
+proc report*[T](want, got: seq[T]): string =
+  ## Returns a message showing every item (using ``$``) prefixed by
+  ## ``"  "`` if it is in both ``want`` and ``got``, ``"- "`` if it is
+  ## only in ``want``, or ``"+ "`` if it is only in ``got``, after a
+  ## ``"-want +got:"`` header line; or an empty string if they are the
+  ## same.
+  ##
+  ## Example:
+  ## ```nim
+  ## echo(report(@[1, 2, 3], @[1, 4, 3]))
+  ## # -want +got:
+  ## #   1
+  ## # - 2
+  ## # + 4
+  ## #   3
+  ## ```
+  if want == got:
+    return ""
+  var lines = @["-want +got:"]
+  for span in spans(want, got):
+    if span.tag == tagEqual:
+      for item in want[span.aStart ..< span.aEnd]:
+        lines.add("  " & $item)
+    else:
+      for item in want[span.aStart ..< span.aEnd]:
+        lines.add("- " & $item)
+      for item in got[span.bStart ..< span.bEnd]:
+        lines.add("+ " & $item)
+  lines.join("\n")
+
+template checkEqualSeqs*(want, got: untyped) =
+  ## Checks that the ``want`` and ``got`` sequences are equal, and if they
+  ## aren't, fails the current test with a unified diff of them (see
+  ## ``seqDiff()``) rather than just reporting that they differ. The diff
+  ## is only computed if they differ.
+  let wantSeq = want
+  let gotSeq = got
+  if wantSeq != gotSeq:
+    checkpoint(seqDiff(wantSeq, gotSeq))
+    fail()
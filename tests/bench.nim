@@ -0,0 +1,90 @@
+# Copyright © 2019-20 Mark Summerfield. All rights reserved.
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may only use this file in compliance with the License. The license
+# is available from http://www.apache.org/licenses/LICENSE-2.0
+
+# Build with -d:release and compare the timings before and after changes.
+
+import diff
+import random
+import strformat
+import times
+
+proc makeLines(rng: var Rand, count: int): seq[string] =
+  for i in 0 ..< count:
+    result.add(&"line {rng.rand(count)}")
+
+proc mutated(rng: var Rand, lines: seq[string], similarity: float):
+    seq[string] =
+  for line in lines:
+    if rng.rand(1.0) < similarity:
+      result.add(line)
+    else:
+      result.add(&"changed {rng.rand(1_000_000)}")
+
+proc bench(size: int, similarity: float, repeats: int) =
+  var rng = initRand(size)
+  let a = makeLines(rng, size)
+  let b = mutated(rng, a, similarity)
+  var count = 0
+  let start = cpuTime()
+  for repeat in 0 ..< repeats:
+    let diff = newDiff(a, b)
+    for span in diff.spans():
+      inc count
+  let elapsed = (cpuTime() - start) / float(repeats)
+  echo(&"size={size:>6} similarity={similarity:.2f} " &
+       &"spans={count div repeats:>6} secs/diff={elapsed:.6f}")
+
+proc benchBestMatch(size, count, repeats: int) =
+  var rng = initRand(size + count)
+  let target = makeLines(rng, size)
+  var candidates = newSeq[seq[string]]()
+  for i in 0 ..< count:
+    candidates.add(mutated(rng, target, rng.rand(1.0)))
+  var start = cpuTime()
+  for repeat in 0 ..< repeats:
+    var best = -1
+    var bestRatio = 0.0
+    for (index, candidate) in candidates.pairs():
+      let ratio = newDiff(candidate, target).ratio()
+      if ratio > bestRatio:
+        best = index
+        bestRatio = ratio
+  let fresh = (cpuTime() - start) / float(repeats)
+  start = cpuTime()
+  let diff = newDiff(newSeq[string](), target)
+  for repeat in 0 ..< repeats:
+    discard diff.bestMatch(candidates)
+  let reused = (cpuTime() - start) / float(repeats)
+  echo(&"size={size:>6} candidates={count:>4} " &
+       &"secs/fresh={fresh:.6f} secs/bestMatch={reused:.6f}")
+
+proc benchReuse(size, count: int) =
+  var rng = initRand(size + count)
+  var inputs = newSeq[(seq[string], seq[string])]()
+  for i in 0 ..< count:
+    let a = makeLines(rng, size)
+    inputs.add((a, mutated(rng, a, rng.rand(1.0))))
+  var start = cpuTime()
+  for (a, b) in inputs:
+    discard newDiff(a, b).matches()
+  let fresh = (cpuTime() - start) / float(count)
+  start = cpuTime()
+  var diff = newDiff(newSeq[string](), newSeq[string]())
+  for (a, b) in inputs:
+    diff.setSeqs(a, b)
+    discard diff.matches()
+  let reused = (cpuTime() - start) / float(count)
+  echo(&"size={size:>6} diffs={count:>6} " &
+       &"secs/fresh={fresh:.6f} secs/setSeqs={reused:.6f}")
+
+when isMainModule:
+  for (size, repeats) in [(100, 1000), (1000, 100), (5000, 10),
+                          (20000, 2)]:
+    for similarity in [0.5, 0.9, 0.99]:
+      bench(size, similarity, repeats)
+  for (size, count, repeats) in [(100, 100, 10), (1000, 50, 2)]:
+    benchBestMatch(size, count, repeats)
+  for (size, count) in [(10, 10_000), (1000, 100)]:
+    benchReuse(size, count)
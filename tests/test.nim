@@ -3,12 +3,19 @@
 # you may only use this file in compliance with the License. The license
 # is available from http://www.apache.org/licenses/LICENSE-2.0
 
+import algorithm
 import diff
+import diff/testing
 import hashes
+import json
+import options
+import random
 import sequtils
+import streams
 import strformat
 import strutils
 import sugar
+import tables
 import unittest
 
 proc replacements*[T](a, b: seq[T]; prefix="% ", sep=" => "): string =
@@ -49,6 +56,32 @@ proc hash(i: Item): Hash =
 proc `==`(a, b: Item): bool =
   a.text == b.text
 
+type
+  Place = object
+    x: int
+    y: int
+    name: string
+
+proc hash(place: Place): Hash =
+  var h: Hash = 0
+  h = h !& hash(place.x)
+  h = h !& hash(place.y)
+  h = h !& hash(place.name)
+  !$h
+
+proc placeFields(place: Place): OrderedTable[string, string] =
+  result = initOrderedTable[string, string]()
+  result["x"] = $place.x
+  result["y"] = $place.y
+  result["name"] = place.name
+
+type
+  Account = object
+    id: int
+    owner: string
+
+proc diffKey(account: Account): string = $account.id
+
 suite "diff tests":
 
   test "01":
@@ -495,3 +528,1770 @@ suite "diff tests":
       of tagEqual:
         for text in span.a:
           echo("= ", text)
+
+  test "26":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    let diff = newDiff(a, b)
+    let expected = @[
+      newSpan(tagEqual, 0, 2, 0, 2),  # the quick
+      newSpan(tagDelete, 2, 3, 2, 2), # brown ->
+      newSpan(tagInsert, 3, 3, 2, 3), # -> red
+      newSpan(tagEqual, 3, 7, 3, 7),  # fox jumped over the
+      newSpan(tagDelete, 7, 8, 7, 7), # lazy ->
+      newSpan(tagInsert, 8, 8, 7, 9), # -> very busy
+      newSpan(tagEqual, 8, 9, 9, 10), # dogs
+      ]
+    let spans = toSeq(diff.spans(noReplace = true))
+    check(len(expected) == len(spans))
+    for (act, exp) in zip(spans, expected):
+      check(act == exp)
+    var aEnd = 0
+    var bEnd = 0
+    for span in spans:
+      check(span.aStart == aEnd and span.bStart == bEnd)
+      aEnd = span.aEnd
+      bEnd = span.bEnd
+    check(aEnd == len(a) and bEnd == len(b))
+    let slices = toSeq(spanSlices(a, b, skipEqual = true,
+                                  noReplace = true))
+    check(map(slices, span => span.tag) ==
+          @[tagDelete, tagInsert, tagDelete, tagInsert])
+
+  test "27":
+    var b = newSeq[string]()
+    for i in 0 ..< 300:
+      b.add(if i mod 60 == 1: "x" else: $i) # "x" is popular
+    let a = @["x"]
+    let diff = newDiff(a, b)
+    var other = diff.clone()
+    other.setAutoJunk(false)
+    other.a.add("y")
+    check(diff.a == @["x"])
+    check(toSeq(diff.spans()) == @[newSpan(tagReplace, 0, 1, 0, 300)])
+    let expected = @[
+      newSpan(tagInsert, 0, 0, 0, 1),    # -> 0
+      newSpan(tagEqual, 0, 1, 1, 2),     # x
+      newSpan(tagReplace, 1, 2, 2, 300), # y -> 2 ... 299
+      ]
+    let spans = toSeq(other.spans())
+    check(len(expected) == len(spans))
+    for (act, exp) in zip(spans, expected):
+      check(act == exp)
+
+  test "28":
+    let a = @[1, 2, 3, 4, 5, 6]
+    let b = @[2, 3, 5, 7]
+    let diff = newDiff(a, b)
+    check(diff.ratio() == 0.6)
+    check($diff == "Diff{len(a)=6 len(b)=4 ratio=0.60 hunks=1}")
+    let same = newDiff(a, a)
+    check($same == "Diff{len(a)=6 len(b)=6 ratio=1.00 hunks=0}")
+    let c = toSeq(1 .. 20)
+    var d = c
+    d[0] = 0
+    d[19] = 0
+    check($newDiff(c, d) == "Diff{len(a)=20 len(b)=20 ratio=0.90 hunks=2}")
+
+  test "29":
+    let a = @["1", "x", "", "", "", "y", "2"]
+    let b = @["1", "X", "", "", "", "Y", "2"]
+    let diff = newDiff(a, b)
+    let groups = toSeq(diff.groupedSpans(context = 1))
+    check(len(groups) == 2)
+    check(groups[0] == @[newSpan(tagEqual, 0, 1, 0, 1),
+                         newSpan(tagReplace, 1, 2, 1, 2),
+                         newSpan(tagEqual, 2, 3, 2, 3)])
+    check(groups[1] == @[newSpan(tagEqual, 4, 5, 4, 5),
+                         newSpan(tagReplace, 5, 6, 5, 6),
+                         newSpan(tagEqual, 6, 7, 6, 7)])
+    proc isBlank(line: string): bool = len(line) == 0
+    let junkGroups = toSeq(diff.groupedSpans(context = 1,
+                                             isJunk = isBlank))
+    check(len(junkGroups) == 1)
+    check(junkGroups[0] == @[newSpan(tagEqual, 0, 1, 0, 1),
+                             newSpan(tagReplace, 1, 2, 1, 2),
+                             newSpan(tagEqual, 2, 5, 2, 5),
+                             newSpan(tagReplace, 5, 6, 5, 6),
+                             newSpan(tagEqual, 6, 7, 6, 7)])
+    check(len(toSeq(newDiff(a, a).groupedSpans())) == 0)
+
+  test "30":
+    let a = @[@["1", "alice", "30"], @["2", "bob", "25"],
+              @["3", "carol", "40"]]
+    let b = @[@["1", "alice", "31"], @["3", "carol", "40"],
+              @["4", "dave", "22"]]
+    let none = newSeq[seq[string]]()
+    let expected = @[
+      newSpanSlice(tagReplace, @[@["1", "alice", "30"]],
+                   @[@["1", "alice", "31"]]),
+      newSpanSlice(tagDelete, @[@["2", "bob", "25"]], none),
+      newSpanSlice(tagEqual, @[@["3", "carol", "40"]],
+                   @[@["3", "carol", "40"]]),
+      newSpanSlice(tagInsert, none, @[@["4", "dave", "22"]]),
+      ]
+    let slices = diffRows(a, b, 0)
+    check(len(expected) == len(slices))
+    for (act, exp) in zip(slices, expected):
+      check(act == exp)
+    expect(ValueError):
+      discard diffRows(a, b, 3)
+
+  test "31":
+    let a = @[@[1, 2, 3], @[4, 5, 6], @[7, 8, 9]]
+    let b = @[@[1, 2, 3], @[0, 0], @[4, 5, 7], @[7, 8, 9]]
+    let expected = @[
+      newGridRow(tagEqual, 0, 0),
+      newGridRow(tagInsert, -1, 1), # -> 0 0
+      newGridRow(tagReplace, 1, 2, @[newSpan(tagReplace, 2, 3, 2, 3)]),
+      newGridRow(tagEqual, 2, 3),
+      ]
+    let rows = diffGrid(a, b)
+    check(len(expected) == len(rows))
+    for (act, exp) in zip(rows, expected):
+      check(act == exp)
+
+  test "32":
+    let a = sequtils.repeat("x", 300)
+    let b = sequtils.repeat("x", 300)
+    let diff = newDiff(a, b, autoJunk = false)
+    check(toSeq(diff.spans()) == @[newSpan(tagEqual, 0, 300, 0, 300)])
+    let limited = newDiff(a, b, autoJunk = false, maxWork = 1000)
+    check(toSeq(limited.spans()) == @[newSpan(tagReplace, 0, 300, 0, 300)])
+    check(limited.spansAnchored(@[(150, 150)]) ==
+          @[newSpan(tagReplace, 0, 300, 0, 300)])
+
+  test "33":
+    var b = newSeq[string]()
+    for i in 0 ..< 300:
+      b.add(if i mod 60 == 1: "x" else: $i) # "x" is popular
+    var diff = newDiff(@["x"], b)
+    check(diff.popularElements() == @["x"])
+    diff.setAutoJunk(false)
+    check(len(diff.popularElements()) == 0)
+    check(len(newDiff(@["x"], b[0 ..< 200]).popularElements()) == 0)
+
+  test "34":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    let (inserted, deleted) = newDiff(a, b).changedItems()
+    check(inserted == @["red", "very", "busy"])
+    check(deleted == @["brown", "lazy"])
+
+  test "35":
+    let a = "A p q B r".split()
+    let b = "A B p q r".split()
+    let diff = newDiff(a, b)
+    let unanchored = @[
+      newSpan(tagEqual, 0, 1, 0, 1),  # A
+      newSpan(tagInsert, 1, 1, 1, 2), # -> B
+      newSpan(tagEqual, 1, 3, 2, 4),  # p q
+      newSpan(tagDelete, 3, 4, 4, 4), # B ->
+      newSpan(tagEqual, 4, 5, 4, 5),  # r
+      ]
+    check(toSeq(diff.spans()) == unanchored)
+    let expected = @[
+      newSpan(tagEqual, 0, 1, 0, 1),  # A
+      newSpan(tagDelete, 1, 3, 1, 1), # p q ->
+      newSpan(tagEqual, 3, 4, 1, 2),  # B
+      newSpan(tagInsert, 4, 4, 2, 4), # -> p q
+      newSpan(tagEqual, 4, 5, 4, 5),  # r
+      ]
+    let spans = diff.spansAnchored(@[(0, 0), (3, 1)])
+    check(len(expected) == len(spans))
+    for (act, exp) in zip(spans, expected):
+      check(act == exp)
+    expect(ValueError):
+      discard diff.spansAnchored(@[(3, 1), (0, 0)])
+    expect(ValueError):
+      discard diff.spansAnchored(@[(1, 1)])
+
+  test "36":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    var b = "the quick red fox jumped over the very busy dogs".split()
+    var diff = newDiff(a, b)
+    diff.replaceB(2, "brown")
+    b[2] = "brown"
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, b).spans()))
+    diff.insertB(0, "so")
+    b.insert("so", 0)
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, b).spans()))
+    diff.deleteB(8)
+    b.delete(8)
+    check(b == "so the quick brown fox jumped over the busy dogs".split())
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, b).spans()))
+    diff.deleteB(8)
+    b.delete(8)
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, b).spans()))
+    check(toSeq(diff.spans()) == @[newSpan(tagInsert, 0, 0, 0, 1),
+                                   newSpan(tagEqual, 0, 7, 1, 8),
+                                   newSpan(tagDelete, 7, 8, 8, 8),
+                                   newSpan(tagEqual, 8, 9, 8, 9)])
+
+  test "37":
+    check(splitLinesKeepEnds("a\nb\n") == @["a\n", "b\n"])
+    check(splitLinesKeepEnds("a\nb") == @["a\n", "b"])
+    check(len(splitLinesKeepEnds("")) == 0)
+    let textA = "one\ntwo\nthree"
+    let textB = "one\n2\nthree\nfour"
+    let diff = newDiff(newStringStream(textA), newStringStream(textB))
+    check(diff.a == @["one\n", "two\n", "three"])
+    check(diff.b == @["one\n", "2\n", "three\n", "four"])
+    let expected = @[
+      newSpan(tagEqual, 0, 1, 0, 1),   # one
+      newSpan(tagReplace, 1, 3, 1, 4), # two three -> 2 three four
+      ]
+    check(toSeq(diff.spans()) == expected)
+    expect(ValueError):
+      discard newDiff(newStringStream(textA), newStringStream(textB),
+                      maxSize = 14)
+
+  test "38":
+    proc unified(textA, textB: string): string =
+      for line in unifiedDiff(splitLinesKeepEnds(textA),
+                              splitLinesKeepEnds(textB)):
+        result.add(line)
+    const header = "--- a\n+++ b\n@@ -1,2 +1,2 @@\n x\n"
+    const marker = "\\ No newline at end of file\n"
+    check(unified("x\ny\n", "x\nz\n") == header & "-y\n+z\n")
+    check(unified("x\ny", "x\nz") == header & "-y\n" & marker & "+z\n" &
+          marker)
+    check(unified("x\ny", "x\ny\n") == header & "-y\n" & marker & "+y\n")
+    check(unified("x\ny\n", "x\ny") == header & "-y\n+y\n" & marker)
+    check(unified("x\ny", "x\ny") == "")
+
+  test "39":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    let diff = newDiff(a, b)
+    check(apply(a, diff.toPatch()) == b)
+    let stream = newStringStream()
+    diff.writePatch(stream, encodeString)
+    stream.setPosition(0)
+    let patch = readPatch[string](stream, decodeString)
+    check(patch == diff.toPatch())
+    check(apply(a, patch) == b)
+    expect(ValueError):
+      discard readPatch[string](newStringStream("PATCH"), decodeString)
+
+  test "40":
+    let a = "foo bar baz quux".split()
+    let b = "foo baz bar quux".split()
+    check(toSeq(newDiff(a, b).spans(skipEqual = true)) ==
+          @[newSpan(tagInsert, 1, 1, 1, 2), # -> baz
+            newSpan(tagDelete, 2, 3, 3, 3)]) # baz ->
+    let trailing = newDiff(a, b, boundary = boundaryTrailing)
+    check(toSeq(trailing.spans(skipEqual = true)) ==
+          @[newSpan(tagDelete, 1, 2, 1, 1), # bar ->
+            newSpan(tagInsert, 3, 3, 2, 3)]) # -> bar
+    let c = toSeq("cbb")
+    let d = toSeq("bcc")
+    check(toSeq(newDiff(c, d).spans()) ==
+          @[newSpan(tagInsert, 0, 0, 0, 1),   # -> b
+            newSpan(tagEqual, 0, 1, 1, 2),    # c
+            newSpan(tagReplace, 1, 3, 2, 3)]) # b b -> c
+    let minimal = newDiff(c, d, boundary = boundaryMinimalReplace)
+    check(toSeq(minimal.spans()) ==
+          @[newSpan(tagDelete, 0, 2, 0, 0), # c b ->
+            newSpan(tagEqual, 2, 3, 0, 1),  # b
+            newSpan(tagInsert, 3, 3, 1, 3)]) # -> c c
+    let same = newDiff(a, b, boundary = boundaryMinimalReplace)
+    check(toSeq(same.spans()) == toSeq(newDiff(a, b).spans()))
+
+  test "41":
+    proc isContiguous(a, b: seq[string]): bool =
+      var aEnd = 0
+      var bEnd = 0
+      for span in newDiff(a, b).spans():
+        if span.aStart != aEnd or span.bStart != bEnd:
+          return false
+        aEnd = span.aEnd
+        bEnd = span.bEnd
+      aEnd == len(a) and bEnd == len(b)
+    let words = "the quick brown fox jumped over the lazy dogs".split()
+    let none = newSeq[string]()
+    check(toSeq(newDiff(words, none).spans()) ==
+          @[newSpan(tagDelete, 0, 9, 0, 0)])
+    check(isContiguous(words, none))
+    check(isContiguous(none, words))
+    check(isContiguous(none, none))
+    check(isContiguous(words, words))
+    check(isContiguous(words, "a quick fox jumped".split()))
+    check(isContiguous("foo bar baz quux".split(),
+                       "foo baz bar quux".split()))
+
+  test "42":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    proc toBytes(words: seq[string]): seq[seq[byte]] =
+      for word in words:
+        result.add(mapIt(word, byte(it)))
+    let diff = newDiff(toBytes(a), toBytes(b))
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, b).spans()))
+
+  test "43":
+    let a = "x y".split()
+    let b = "x y z".split()
+    let spans = @[newSpan(tagEqual, 0, 1, 0, 1),   # x
+                  newSpan(tagReplace, 1, 2, 1, 3)] # y -> y z
+    check(minimalizeEdits(a, b, spans) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2),   # x y
+            newSpan(tagInsert, 2, 2, 2, 3)]) # -> z
+    let c = "p q r s".split()
+    let d = "p s".split()
+    check(minimalizeEdits(c, d, @[newSpan(tagEqual, 0, 1, 0, 1),
+                                  newSpan(tagReplace, 1, 4, 1, 2)]) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),  # p
+            newSpan(tagDelete, 1, 3, 1, 1), # q r ->
+            newSpan(tagEqual, 3, 4, 1, 2)]) # s
+    let diff = newDiff(a, b)
+    check(diff.minimalizeEdits() == toSeq(diff.spans()))
+
+  test "44":
+    let a = @["a\tb\n", "c\n"]
+    let b = @["a\tB\n", "c\n"]
+    proc visibleTabs(line: string): string = line.replace("\t", "→")
+    var lines = newSeq[string]()
+    for line in unifiedDiff(a, b, visibleTabs):
+      lines.add(line)
+    check(lines == @["--- a\n", "+++ b\n", "@@ -1,2 +1,2 @@\n", "-a→b\n",
+                     "+a→B\n", " c\n"])
+    lines.setLen(0)
+    for line in unifiedDiff(@[1, 2, 3], @[1, 4, 3], formatDollar[int],
+                            fromFile = "old", toFile = "new"):
+      lines.add(line)
+    check(lines == @["--- old\n", "+++ new\n", "@@ -1,3 +1,3 @@\n", " 1\n",
+                     "-2\n", "+4\n", " 3\n"])
+
+  test "45":
+    let a = "a x , y b".split()
+    let b = "a , b".split()
+    let diff = newDiff(a, b)
+    check(toSeq(diff.spans(skipEqual = true)) ==
+          @[newSpan(tagDelete, 1, 2, 1, 1),  # x ->
+            newSpan(tagDelete, 3, 4, 2, 2)]) # y ->
+    check(diff.absorbEqualGaps(1) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),   # a
+            newSpan(tagReplace, 1, 4, 1, 2), # x , y -> ,
+            newSpan(tagEqual, 4, 5, 2, 3)])  # b
+    check(diff.absorbEqualGaps(0) == toSeq(diff.spans()))
+    let c = "x1 x2 , x3 end".split()
+    let d = "y1 y2 , y3 end".split()
+    check(newDiff(c, d).absorbEqualGaps(1) ==
+          @[newSpan(tagReplace, 0, 4, 0, 4), # x1 x2 , x3 -> y1 y2 , y3
+            newSpan(tagEqual, 4, 5, 4, 5)])  # end
+
+  test "46":
+    let a = toSeq("qabxcd")
+    let b = toSeq("abycdf")
+    let matcher = newSequenceMatcher(a, b)
+    check(matcher.getOpcodes() == @[("delete", 0, 1, 0, 0),
+                                    ("equal", 1, 3, 0, 2),
+                                    ("replace", 3, 4, 2, 3),
+                                    ("equal", 4, 6, 3, 5),
+                                    ("insert", 6, 6, 5, 6)])
+    check(matcher.getMatchingBlocks() == @[newMatch(1, 0, 2),
+                                           newMatch(4, 3, 2),
+                                           newMatch(6, 6, 0)])
+    check(formatFloat(matcher.ratio(), ffDecimal, 3) == "0.667")
+
+  test "47":
+    let a = @[@["1", "Paris", "2"], @["2", "Rome", "4"],
+              @["3", "Oslo", "6"]]
+    let b = @[@["1", "Paris", "2"], @["2", "Roma", "5"],
+              @["3", "Oslo", "6"]]
+    let slices = diffRows(a, b, 0)
+    check(len(slices) == 3)
+    let (before, after, ok) = slices[1].replacePair()
+    check(ok)
+    check(before == @[@["2", "Rome", "4"]])
+    check(after == @[@["2", "Roma", "5"]])
+    var changes = newSeq[string]()
+    for (i, field) in before[0].pairs():
+      if field != after[0][i]:
+        changes.add(&"{i}: {field} -> {after[0][i]}")
+    check(changes == @["1: Rome -> Roma", "2: 4 -> 5"])
+    check(not slices[0].replacePair().ok)
+
+  test "48":
+    let a = @[Place(x: 1, y: 2, name: "A"), Place(x: 5, y: 5, name: "B")]
+    let b = @[Place(x: 1, y: 2, name: "A"), Place(x: 2, y: 5, name: "C")]
+    let slices = toSeq(spanSlices(a, b, skipEqual = true))
+    check(len(slices) == 1)
+    let (before, after, ok) = slices[0].replacePair()
+    check(ok)
+    let changes = fieldChanges(before[0], after[0], placeFields)
+    check(toSeq(changes.keys()) == @["x", "name"])
+    check(changes["x"] == ("5", "2"))
+    check(changes["name"] == ("B", "C"))
+    check(len(fieldChanges(a[0], b[0], placeFields)) == 0)
+
+  test "49":
+    let a = @["# Title", "text"]
+    let b = @["text", "# Title"]
+    proc one(line: string): int = 1
+    proc two(x, y: string): int = 2
+    proc keepHeadings(line: string): int =
+      if line.startsWith('#'): 10 else: 1
+    check(costSpans(a, b, one, one, two) ==
+          @[newSpan(tagDelete, 0, 1, 0, 0),  # # Title ->
+            newSpan(tagEqual, 1, 2, 0, 1),   # text
+            newSpan(tagInsert, 2, 2, 1, 2)]) # -> # Title
+    check(costSpans(a, b, one, keepHeadings, two) ==
+          @[newSpan(tagInsert, 0, 0, 0, 1),  # -> text
+            newSpan(tagEqual, 0, 1, 1, 2),   # # Title
+            newSpan(tagDelete, 1, 2, 2, 2)]) # text ->
+    proc cheap(x, y: string): int = 1
+    check(costSpans(@["x", "A", "y"], @["x", "B", "y"], one, one, cheap) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),   # x
+            newSpan(tagReplace, 1, 2, 1, 2), # A -> B
+            newSpan(tagEqual, 2, 3, 2, 3)])  # y
+    check(len(costSpans(newSeq[string](), newSeq[string](), one, one,
+                        cheap)) == 0)
+
+  test "50":
+    var b = newSeq[string]()
+    for i in 0 ..< 300:
+      let word = case i mod 10
+                 of 3: "the"
+                 of 6: "a"
+                 of 9: "and"
+                 else: &"word{i}"
+      b.add(word)
+    var a = b
+    a.delete(40, 59)
+    a.insert(@["new", "words", "the"], 100)
+    let first = newDiff(a, b)
+    check(first.popularElements() == @["the", "a", "and"])
+    for run in 0 ..< 5:
+      let diff = newDiff(a, b)
+      check(diff.popularElements() == first.popularElements())
+      check(toSeq(diff.spans()) == toSeq(first.spans()))
+
+  test "51":
+    let a = @["1", "x", "", "", "", "y", "2"]
+    let b = @["1", "X", "", "", "", "Y", "2"]
+    let diff = newDiff(a, b)
+    proc isBlank(line: string): bool = len(line) == 0
+    for context in 0 .. 3:
+      check(diff.hunkCount(context) ==
+            len(toSeq(diff.groupedSpans(context))))
+      check(diff.hunkCount(context, isBlank) ==
+            len(toSeq(diff.groupedSpans(context, isBlank))))
+    check(diff.hunkCount(1) == 2)
+    check(diff.hunkCount(1, isBlank) == 1)
+    check(diff.hunkCount(0) == 2)
+    check(newDiff(a, a).hunkCount() == 0)
+    check(newDiff(a, @["1"]).hunkCount() == 1)
+
+  test "52":
+    let a = "a b c d e f g".split()
+    let b = "a x c d f g h".split()
+    let diff = newDiff(a, b)
+    # equal a, replace b -> x, equal c d, delete e, equal f g, insert h
+    check(diff.alignmentAtoB() == @[0, -1, 2, 3, -1, 4, 5])
+    check(diff.alignmentBtoA() == @[0, -1, 2, 3, 5, 6, -1])
+    let empty = newDiff(newSeq[string](), b)
+    check(len(empty.alignmentAtoB()) == 0)
+    check(empty.alignmentBtoA() == sequtils.repeat(-1, len(b)))
+
+  test "53":
+    let a = @["start", "alpha beta", "junk", "gamma delta", "end"]
+    let b = @["start", "alpha betta", "gamma delta!", "end"]
+    check(toSeq(spanSlices(a, b, skipEqual = true)) ==
+          @[newSpanSlice(tagReplace, a[1 .. 3], b[1 .. 2])])
+    check(toSeq(pairedSpanSlices(a, b)) ==
+          @[newSpanSlice(tagEqual, @["start"], @["start"]),
+            newSpanSlice(tagReplace, @["alpha beta"], @["alpha betta"]),
+            newSpanSlice(tagDelete, @["junk"], newSeq[string]()),
+            newSpanSlice(tagReplace, @["gamma delta"], @["gamma delta!"]),
+            newSpanSlice(tagEqual, @["end"], @["end"])])
+    check(toSeq(pairedSpanSlices(@["abc"], @["xyz"])) ==
+          @[newSpanSlice(tagDelete, @["abc"], newSeq[string]()),
+            newSpanSlice(tagInsert, newSeq[string](), @["xyz"])])
+
+  test "54":
+    let empty = newSeq[string]()
+    let words = "one two three".split()
+    let none = newDiff(empty, empty)
+    check(len(toSeq(none.spans())) == 0)
+    check(len(toSeq(spanSlices(empty, empty))) == 0)
+    check(none.ratio() == 1.0)
+    check(none.matches() == @[newMatch(0, 0, 0)])
+    let same = newDiff(words, words)
+    check(toSeq(same.spans()) == @[newSpan(tagEqual, 0, 3, 0, 3)])
+    check(toSeq(spanSlices(words, words)) ==
+          @[newSpanSlice(tagEqual, words, words)])
+    check(same.ratio() == 1.0)
+    check(len(toSeq(same.spans(skipEqual = true))) == 0)
+    let inserted = newDiff(empty, words)
+    check(toSeq(inserted.spans()) == @[newSpan(tagInsert, 0, 0, 0, 3)])
+    check(inserted.ratio() == 0.0)
+    let deleted = newDiff(words, empty)
+    check(toSeq(deleted.spans()) == @[newSpan(tagDelete, 0, 3, 0, 0)])
+    check(toSeq(spanSlices(words, empty)) ==
+          @[newSpanSlice(tagDelete, words, empty)])
+    check(deleted.ratio() == 0.0)
+
+  test "55":
+    check(intralineMarks("the cafe is open", "the café was open") ==
+          ("       ^ ^      ", "       ^ ^^      "))
+    check(intralineMarks("the café is open", "the cafe was open") ==
+          ("       ^ ^      ", "       ^ ^^      "))
+    check(intralineMarks("same", "same") == ("    ", "    "))
+    check(intralineMarks("", "new") == ("", "^^^"))
+
+  test "56":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    var calls = newSeq[(int, int)]()
+    proc progress(done, total: int) = calls.add((done, total))
+    let diff = newDiff(a, b, progress = progress)
+    check(len(calls) == 0)
+    let spans = toSeq(diff.spans())
+    check(spans == toSeq(newDiff(a, b).spans()))
+    check(len(calls) > 0)
+    check(calls[^1] == (len(a) + len(b), len(a) + len(b)))
+    for i in 1 ..< len(calls):
+      check(calls[i - 1][0] <= calls[i][0])
+      check(calls[i][1] == len(a) + len(b))
+
+  test "57":
+    let a = "Tulips are yellow,\nViolets are blue,\nAgar is sweet,\n" &
+            "As are you.\n"
+    let b = "Roses are red,\nViolets are blue,\nSugar is sweet,\n" &
+            "And so are you.\n"
+    check(diffText(a, b) == @["@@ -1,4 +1,4 @@",
+                              "-Tulips are yellow,",
+                              "+Roses are red,",
+                              " Violets are blue,",
+                              "-Agar is sweet,",
+                              "-As are you.",
+                              "+Sugar is sweet,",
+                              "+And so are you."])
+    check(diffText("one\ntwo", "one\ntwo\n", context = 0) ==
+          @["@@ -2 +2 @@", "-two", "\\ No newline at end of file",
+            "+two"])
+    check(len(diffText(a, a)) == 0)
+
+  test "58":
+    let a = "one two three four".split()
+    checkEqualSeqs(a, "one two three four".split())
+    check(len(seqDiff(a, a)) == 0)
+    check(seqDiff(a, "one 2 three four".split()) ==
+          "--- want\n+++ got\n@@ -1,4 +1,4 @@\n one\n-two\n+2\n three\n" &
+          " four\n")
+    check(seqDiff(@[1, 2], @[1]) ==
+          "--- want\n+++ got\n@@ -1,2 +1 @@\n 1\n-2\n")
+
+  test "59":
+    # Items are == if their texts are equal, so use eq to also require
+    # equal x values
+    let a = @[newItem(1, 0, "a"), newItem(2, 0, "b"), newItem(3, 0, "c")]
+    let b = @[newItem(9, 0, "a"), newItem(2, 0, "b"), newItem(3, 0, "c")]
+    check(toSeq(newDiff(a, b).spans()) == @[newSpan(tagEqual, 0, 3, 0, 3)])
+    proc sameX(x, y: Item): bool = x.x == y.x
+    let diff = newDiff(a, b, eq = sameX)
+    check(toSeq(diff.spans()) == @[newSpan(tagReplace, 0, 1, 0, 1),
+                                   newSpan(tagEqual, 1, 3, 1, 3)])
+    check(diff.matches() == @[newMatch(1, 1, 2), newMatch(3, 3, 0)])
+
+  test "60":
+    let a = @[1, 2, 3, 4, 5, 6]
+    let b = @[2, 3, 5, 7]
+    let diff = newDiff(a, b)
+    check(diff.opCounts() == (equals: 2, inserts: 0, deletes: 2,
+                              replaces: 1))
+    check(newDiff(b, a).opCounts() == (2, 2, 0, 1))
+    check(newDiff(a, a).opCounts() == (1, 0, 0, 0))
+    check(newDiff(newSeq[int](), newSeq[int]()).opCounts() == (0, 0, 0, 0))
+
+  test "61":
+    let unix = "one\ntwo\nthree\n"
+    let mixed = "one\r\ntwo\rthree\r\n"
+    check(normalizedEol(mixed) == unix)
+    check(onlyEolDiffers(unix, mixed))
+    check(not onlyEolDiffers(unix, unix))
+    check(not onlyEolDiffers(unix, "one\r\nTWO\nthree\n"))
+    check(len(diffText(unix, mixed)) > 0)
+    check(len(diffText(unix, mixed, normalizeEol = true)) == 0)
+    check(diffText(unix, "one\r\nTWO\nthree\r\n", normalizeEol = true) ==
+          @["@@ -1,3 +1,3 @@", " one", "-two", "+TWO", " three"])
+    let diff = newDiff(newStringStream(unix), newStringStream(mixed),
+                       normalizeEol = true)
+    check(toSeq(diff.spans()) == @[newSpan(tagEqual, 0, 3, 0, 3)])
+    let raw = newDiff(newStringStream(unix), newStringStream(mixed))
+    check(raw.b == @["one\r\n", "two\rthree\r\n"])
+
+  test "62":
+    let diff = newDiff(toSeq("abcd"), toSeq("dcba"))
+    check(diff.quickRatio() == 1.0)
+    check(diff.ratio() == 0.25)
+    let (spans, ok) = diff.spansIfSimilar(0.9)
+    check(ok)
+    check(spans == toSeq(diff.spans()))
+    var calls = 0
+    proc progress(done, total: int) = inc calls
+    let other = newDiff(toSeq("abcd"), toSeq("wxya"), progress = progress)
+    check(other.quickRatio() == 0.25)
+    check(other.spansIfSimilar(0.5) == (newSeq[Span](), false))
+    check(calls == 0)
+    check(other.spansIfSimilar(0.25).ok)
+    check(calls > 0)
+    check(newDiff(newSeq[int](), newSeq[int]()).quickRatio() == 1.0)
+
+  test "63":
+    let a = @[1, 2, 3, 4, 5, 6]
+    let b = @[2, 3, 5, 7]
+    let diff = newDiff(a, b)
+    let matches = diff.matches()
+    check(matches[^1] == newMatch(6, 4, 0))
+    check(diff.getMatchingBlocks() == matches)
+    check(diff.matches(withSentinel = false) == matches[0 .. ^2])
+    check(diff.matches(withSentinel = false) == @[newMatch(1, 0, 2),
+                                                 newMatch(4, 2, 1)])
+    let none = newDiff(newSeq[int](), newSeq[int]())
+    check(none.matches() == @[newMatch(0, 0, 0)])
+    check(len(none.matches(withSentinel = false)) == 0)
+
+  test "64":
+    proc lines(count: int): (seq[string], seq[string]) =
+      var b = newSeq[string]()
+      for i in 0 ..< count:
+        b.add(if i mod 10 == 9: "" else: &"line{i}")
+      var a = b
+      a[50] = "changed"
+      a.delete(120)
+      (a, b)
+    for count in [199, 201]:
+      let (a, b) = lines(count)
+      let diff = newDiff(a, b)
+      check(toSeq(diff.spans(skipEqual = true)) ==
+            @[newSpan(tagReplace, 50, 51, 50, 51),
+              newSpan(tagInsert, 120, 120, 120, 121)])
+      check(len(diff.popularElements()) == (if count > 200: 1 else: 0))
+    proc cycle(count: int): (seq[string], seq[string]) =
+      var b = newSeq[string]()
+      for i in 0 ..< count:
+        b.add(["x", "y", "z"][i mod 3])
+      var a = b
+      a[50] = "w"
+      (a, b)
+    let (a, b) = cycle(199)
+    check(toSeq(newDiff(a, b).spans(skipEqual = true)) ==
+          @[newSpan(tagDelete, 0, 51, 0, 0),
+            newSpan(tagInsert, 199, 199, 148, 199)])
+    # All the items are popular, so nothing can be matched
+    let (c, d) = cycle(201)
+    check(toSeq(newDiff(c, d).spans(skipEqual = true)) ==
+          @[newSpan(tagReplace, 50, 201, 50, 201)])
+    let predictable = newDiff(c, d, autoJunkMin = 1000)
+    check(toSeq(predictable.spans(skipEqual = true)) ==
+          @[newSpan(tagDelete, 0, 51, 0, 0),
+            newSpan(tagInsert, 201, 201, 150, 201)])
+
+  test "65":
+    let diff = newDiff(toSeq("qabxcd"), toSeq("abycdf"))
+    check(diff.operations() == @[(tagDelete, 'q'), (tagEqual, 'a'),
+                                 (tagEqual, 'b'), (tagDelete, 'x'),
+                                 (tagInsert, 'y'), (tagEqual, 'c'),
+                                 (tagEqual, 'd'), (tagInsert, 'f')])
+    let a = "foo\nbar\nbaz\nquux".split('\n')
+    let b = "foo\nbaz\nbar\nquux".split('\n')
+    let ops = newDiff(a, b).operations()
+    check(ops.filterIt(it.tag != tagInsert).mapIt(it.item) == a)
+    check(ops.filterIt(it.tag != tagDelete).mapIt(it.item) == b)
+
+  test "66":
+    let a = @[1, 3, 4, 5, 9, 10, 12]
+    let b = @[2, 3, 4, 6, 7, 9, 12, 15]
+    check(sortedSpans(a, b) == @[newSpan(tagDelete, 0, 1, 0, 0),  # 1 ->
+                                 newSpan(tagInsert, 1, 1, 0, 1),  # -> 2
+                                 newSpan(tagEqual, 1, 3, 1, 3),   # 3 4
+                                 newSpan(tagDelete, 3, 4, 3, 3),  # 5 ->
+                                 newSpan(tagInsert, 4, 4, 3, 5),  # -> 6 7
+                                 newSpan(tagEqual, 4, 5, 5, 6),   # 9
+                                 newSpan(tagDelete, 5, 6, 6, 6),  # 10 ->
+                                 newSpan(tagEqual, 6, 7, 6, 7),   # 12
+                                 newSpan(tagInsert, 7, 7, 7, 8)]) # -> 15
+    var c = newSeq[int]()
+    var d = newSeq[int]()
+    var seed = 7
+    for i in 0 ..< 500:
+      seed = (seed * 1103515245 + 12345) mod 2147483648
+      if seed mod 3 != 0:
+        c.add(i)
+      if seed mod 5 != 0:
+        d.add(i)
+    check(sortedSpans(c, d) == toSeq(spans(c, d, noReplace = true)))
+    check(sortedSpans(c, d, skipEqual = true) ==
+          toSeq(spans(c, d, skipEqual = true, noReplace = true)))
+    check(len(sortedSpans(newSeq[int](), newSeq[int]())) == 0)
+
+  test "67":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    check(applySlices(toSeq(spanSlices(a, b))) == b)
+    check(applySlices(toSeq(spanSlices(a, b, noReplace = true))) == b)
+    check(applySlices(toSeq(spanSlices(b, a))) == a)
+    check(len(applySlices(toSeq(spanSlices(a, newSeq[string]())))) == 0)
+    check(len(applySlices(newSeq[SpanSlice[string]]())) == 0)
+
+  test "68":
+    # Each match leaves unmatched ranges either side, so the queue grows
+    # to about one range per separator
+    var a = newSeq[string]()
+    var b = newSeq[string]()
+    for i in 0 ..< 50:
+      a.add([&"a{i}", &"s{i}"])
+      b.add([&"b{i}", &"s{i}"])
+    let spans = toSeq(newDiff(a, b).spans())
+    check(len(spans) == 100)
+    check(toSeq(newDiff(a, b, maxQueue = 50).spans()) == spans)
+    let capped = newDiff(a, b, maxQueue = 10)
+    check(toSeq(capped.spans()) == @[newSpan(tagReplace, 0, 100, 0, 100)])
+    check(capped.matches() == @[newMatch(100, 100, 0)])
+
+  test "69":
+    let pairs = @[(@[1, 2, 3, 4, 5, 6], @[2, 3, 5, 7]), # -1 -4 -6 +7
+                  (@[1, 2, 3], @[1, 2, 3]),             # same
+                  (newSeq[int](), @[8, 9]),             # +8 +9
+                  (@[4, 5], @[4, 6, 7])]                # -5 +6 +7
+    let stat = shortStat(pairs)
+    check(stat == (files: 3, insertions: 5, deletions: 4))
+    check(shortStat(pairs) == stat)
+    check(shortStat(newSeq[(seq[int], seq[int])]()) == (0, 0, 0))
+
+  test "70":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    let spans = toSeq(newDiff(a, b).spans())
+    proc collide(word: string): Hash = 0
+    proc byLength(word: string): Hash = hash(len(word))
+    check(toSeq(newDiff(a, b, hasher = collide).spans()) == spans)
+    check(toSeq(newDiff(a, b, hasher = byLength).spans()) == spans)
+    var diff = newDiff(a, b, hasher = byLength)
+    diff.replaceB(2, "brown")
+    diff.deleteB(7)
+    diff.insertB(8, "lazy")
+    let edited = ("the quick brown fox jumped over the busy " &
+                  "lazy dogs").split()
+    check(diff.b == edited)
+    check(toSeq(diff.spans()) == toSeq(newDiff(a, edited).spans()))
+
+  test "71":
+    check(newSpan(tagReplace, 4, 7, 4, 6).lineRange() == (5, 3, 5, 2))
+    let a = @[1, 2, 3, 4, 5, 6]
+    let b = @[2, 3, 5, 7]
+    let ranges = toSeq(newDiff(a, b).spans()).mapIt(it.lineRange())
+    check(ranges == @[(aFrom: 1, aCount: 1, bFrom: 0, bCount: 0), # 1 ->
+                      (2, 2, 1, 2),                                # 2 3
+                      (4, 1, 2, 0),                                # 4 ->
+                      (5, 1, 3, 1),                                # 5
+                      (6, 1, 4, 1)])                               # 6 -> 7
+    check(newSpan(tagInsert, 0, 0, 0, 2).lineRange() == (0, 0, 1, 2))
+
+  test "72":
+    var a = @["start"]
+    var b = @["start"]
+    for i in 0 ..< 100:
+      a.add(&"old{i}")
+      b.add(&"new{i}")
+    a.add("end")
+    b.add("end")
+    let diff = newDiff(a, b)
+    for context in [0, 1, 3, 50, 200]:
+      let groups = toSeq(diff.groupedSpans(context))
+      check(len(groups) == 1)
+      check(groups[0].filterIt(it.tag != tagEqual) ==
+            @[newSpan(tagReplace, 1, 101, 1, 101)])
+      check(diff.hunkCount(context) == 1)
+
+  test "73":
+    let a = @["if x:", "    y()", "    z()", "w()"]
+    let b = @["if x:", "  y()", "  z()", "w()", "v()"]
+    proc stripped(line: string): string = line.strip()
+    check(normalizedSpans(a, b, stripped) ==
+          @[(newSpan(tagEqual, 0, 1, 0, 1), false),  # if x:
+            (newSpan(tagEqual, 1, 3, 1, 3), true),   # y() z()
+            (newSpan(tagEqual, 3, 4, 3, 4), false),  # w()
+            (newSpan(tagInsert, 4, 4, 4, 5), false)]) # -> v()
+    check(normalizedSpans(a, a, stripped) ==
+          @[(newSpan(tagEqual, 0, 4, 0, 4), false)])
+
+  test "74":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    for boundary in [boundaryLeading, boundaryTrailing,
+                     boundaryMinimalReplace]:
+      let diff = newDiff(a, b, boundary = boundary)
+      check(toSeq(diff.lazyMatches()) == diff.matches())
+    # Count the hashes computed to measure the work done
+    var hashCount = 0
+    proc counted(item: string): Hash =
+      inc hashCount
+      hash(item)
+    var c = newSeq[string]()
+    var d = newSeq[string]()
+    for i in 0 ..< 50:
+      c.add([&"a{i}", &"s{i}"])
+      d.add([&"b{i}", &"s{i}"])
+    let diff = newDiff(c, d, hasher = counted)
+    hashCount = 0
+    var first = newSeq[Match]()
+    for match in diff.lazyMatches():
+      first.add(match)
+      if len(first) == 3:
+        break
+    let firstHashes = hashCount
+    hashCount = 0
+    let matches = toSeq(diff.lazyMatches())
+    check(firstHashes * 3 < hashCount)
+    check(matches == diff.matches())
+    check(first == matches[0 .. 2])
+    let empty = newDiff(newSeq[string](), newSeq[string]())
+    check(toSeq(empty.lazyMatches()) == @[newMatch(0, 0, 0)])
+    var calls = newSeq[(int, int)]()
+    proc progress(done, total: int) = calls.add((done, total))
+    discard toSeq(newDiff(a, b, progress = progress).lazyMatches())
+    check(len(calls) > 0)
+    check(calls[^1] == (len(a) + len(b), len(a) + len(b)))
+    for i in 1 ..< len(calls):
+      check(calls[i - 1][0] <= calls[i][0])
+
+  test "75":
+    check(report(@[1, 2, 3], @[1, 4, 3]) ==
+          "-want +got:\n  1\n- 2\n+ 4\n  3")
+    check(report(@["a", "b"], @["a", "b"]) == "")
+    check(report(newSeq[string](), @["new"]) == "-want +got:\n+ new")
+
+  test "76":
+    # Nim seqs can't be nil; a default-initialized seq is empty
+    var none: seq[string]
+    let b = "one two".split()
+    let inserted = newDiff(none, b)
+    check(toSeq(inserted.spans()) == @[newSpan(tagInsert, 0, 0, 0, 2)])
+    check(toSeq(spanSlices(none, b)) ==
+          @[newSpanSlice(tagInsert, newSeq[string](), b)])
+    check(inserted.ratio() == 0.0)
+    let deleted = newDiff(b, none)
+    check(toSeq(deleted.spans()) == @[newSpan(tagDelete, 0, 2, 0, 0)])
+    check(deleted.ratio() == 0.0)
+    let neither = newDiff(none, none)
+    check(len(toSeq(neither.spans())) == 0)
+    check(neither.ratio() == 1.0)
+    check(toSeq(newDiff(none, b).spans()) ==
+          toSeq(newDiff(newSeq[string](), b).spans()))
+
+  test "77":
+    let a = @[1, 2, 3, 4, 5, 6]
+    let b = @[2, 3, 5, 7]
+    let slices = toSeq(spanSlices(a, b, skipEqual = true,
+                                  noReplace = true))
+    check(slices == @[newSpanSlice(tagDelete, @[1], newSeq[int]()),
+                      newSpanSlice(tagDelete, @[4], newSeq[int]()),
+                      newSpanSlice(tagDelete, @[6], newSeq[int]()),
+                      newSpanSlice(tagInsert, newSeq[int](), @[7])])
+    check(coalesceSlices(slices) ==
+          @[newSpanSlice(tagDelete, @[1, 4, 6], newSeq[int]()),
+            newSpanSlice(tagInsert, newSeq[int](), @[7])])
+    let all = toSeq(spanSlices(a, b))
+    check(coalesceSlices(all) == all)
+
+  test "78":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    proc isJunk(word: string): bool = word in ["{", "}", ""]
+    let diff = newDiff(a, b)
+    let similarity = diff.ratioExcludingJunk(isJunk)
+    check(abs(similarity - diff.ratio()) < 1e-9)
+    var c = newSeq[string]()
+    var d = newSeq[string]()
+    for word in a:
+      c.add(["{", word, "}", ""])
+    for word in b:
+      d.add(["{", word, "}", ""])
+    let junky = newDiff(c, d)
+    check(junky.ratio() - diff.ratio() > 0.15)
+    check(abs(junky.ratioExcludingJunk(isJunk) - similarity) < 0.05)
+    let allJunk = newDiff(@["{", ""], @["}"])
+    check(allJunk.ratioExcludingJunk(isJunk) == 1.0)
+
+  test "79":
+    let a = @["name = x\n", "size = 10\n", "colour = red\n"]
+    let b = @["name = x\n", "size = 1000\n", "colour = blue\n"]
+    check(toSeq(unifiedDiff(a, b, alignColumns = true)) ==
+          @["--- a\n", "+++ b\n", "@@ -1,3 +1,3 @@\n",
+            " name   = x\n",
+            "-size   = 10\n",
+            "-colour = red\n",
+            "+size   = 1000\n",
+            "+colour = blue\n"])
+    # Differing numbers of fields: output as normal
+    let c = @["name = x\n", "size = 10\n"]
+    let d = @["name = x\n", "size = 10 # bytes\n"]
+    check(toSeq(unifiedDiff(c, d, alignColumns = true)) ==
+          toSeq(unifiedDiff(c, d)))
+
+  test "80":
+    let a = "a b c d e".split()
+    let b = "a B c D1 D2 e".split()
+    let spans = toSeq(newDiff(a, b).spans(skipEqual = true))
+    check(spans == @[newSpan(tagReplace, 1, 2, 1, 2),  # b -> B
+                     newSpan(tagReplace, 3, 4, 3, 5)]) # d -> D1 D2
+    check(spans[0].inPlace())
+    check(not spans[1].inPlace())
+    check(not newSpan(tagEqual, 0, 1, 0, 1).inPlace())
+
+  test "81":
+    let a = @[Place(x: 1, y: 2, name: "A"), Place(x: 5, y: 5, name: "B"),
+              Place(x: 3, y: 1, name: "C")]
+    let b = @[Place(x: 1, y: 2, name: "A"), Place(x: 2, y: 5, name: "B"),
+              Place(x: 4, y: 4, name: "D")]
+    proc name(place: Place): string = place.name
+    check(toSeq(newKeyDiff(a, b, name).spans()) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2),    # A B
+            newSpan(tagReplace, 2, 3, 2, 3)]) # C -> D
+    check(toSeq(newStringKeyDiff(a, b).spans()) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),    # A
+            newSpan(tagReplace, 1, 3, 1, 3)]) # B C -> B' D
+    check(newStringKeyDiff(@[1, 2], @[2]).a == @["1", "2"])
+
+  test "82":
+    let stream = newStringStream()
+    newDiff(@["x", "y", "z"], @["y", "z"]).writeDot(stream)
+    check(stream.data == """digraph diff {
+  rankdir=LR;
+  subgraph cluster_a {
+    label="a";
+    a0 [label="0"];
+    a1 [label="1"];
+    a2 [label="2"];
+  }
+  subgraph cluster_b {
+    label="b";
+    b0 [label="0"];
+    b1 [label="1"];
+  }
+  a1 -> b0;
+  a2 -> b1;
+}
+""")
+
+  test "83":
+    # Expected values are from Python's difflib.SequenceMatcher
+    proc isSpace(c: char): bool = c == ' '
+    let a = toSeq("private Thread currentThread;")
+    let b = toSeq("private volatile Thread currentThread;")
+    let plain = newSequenceMatcher(a, b)
+    check(plain.getOpcodes() == @[("equal", 0, 6, 0, 6),
+                                  ("insert", 6, 6, 6, 15),
+                                  ("equal", 6, 29, 15, 38)])
+    let junk = newDiff(a, b, isJunk = isSpace)
+    check(junk.getOpcodes() == @[("equal", 0, 8, 0, 8),
+                                 ("insert", 8, 8, 8, 17),
+                                 ("equal", 8, 29, 17, 38)])
+    check(formatFloat(junk.ratio(), ffDecimal, 6) == "0.865672")
+    let c = toSeq(" abcd")
+    let d = toSeq("abcd abcd")
+    check(formatFloat(newDiff(c, d).ratio(), ffDecimal, 6) == "0.714286")
+    let junkCD = newDiff(c, d, isJunk = isSpace)
+    check(formatFloat(junkCD.ratio(), ffDecimal, 6) == "0.571429")
+    check(junkCD.getMatchingBlocks() == @[newMatch(1, 0, 4),
+                                          newMatch(5, 9, 0)])
+    check(toSeq(unifiedDiff(c, d, formatDollar[char], context = 0,
+                            isJunk = isSpace)) ==
+          @["--- a\n", "+++ b\n", "@@ -1 +0,0 @@\n", "- \n",
+            "@@ -5,0 +5,5 @@\n", "+ \n", "+a\n", "+b\n", "+c\n", "+d\n"])
+    # difflib's autojunk applies from exactly 200 items
+    var e = newSeq[string]()
+    for i in 0 ..< 200:
+      e.add(if i mod 60 == 1: "x" else: $i) # "x" is popular
+    let matcher = newSequenceMatcher(@["x"], e)
+    check(matcher.popularElements() == @["x"])
+    check(matcher.getMatchingBlocks() == @[newMatch(1, 200, 0)])
+    check(newDiff(@["x"], e, autoJunkMin = 199).getMatchingBlocks() ==
+          matcher.getMatchingBlocks())
+    check(len(newDiff(@["x"], e).popularElements()) == 0)
+
+  test "84":
+    let a = "the quick brown fox jumped over the lazy dogs".split()
+    let b = "the quick red fox jumped over the very busy dogs".split()
+    let diff = newDiff(a, b)
+    let edits = diff.edits()
+    check(edits == @[(aStart: 2, aEnd: 3, newItems: @["red"]),
+                     (7, 8, @["very", "busy"])])
+    var buffer = a
+    for i in countdown(len(edits) - 1, 0):
+      let edit = edits[i]
+      buffer[edit.aStart ..< edit.aEnd] = edit.newItems
+    check(buffer == b)
+    let c = @[1, 2, 3, 4, 5, 6]
+    let d = @[2, 3, 5, 7, 8]
+    var numbers = c
+    for edit in newDiff(c, d).edits().reversed():
+      numbers[edit.aStart ..< edit.aEnd] = edit.newItems
+    check(numbers == d)
+    check(len(newDiff(a, a).edits()) == 0)
+
+  test "85":
+    let target = "the quick brown fox".split()
+    let candidates = @["a slow brown dog".split(),
+                       "the quick brown cat".split(),
+                       "the quick red fox".split(),
+                       "nothing in common".split()]
+    let diff = newDiff(newSeq[string](), target)
+    let (index, similarity) = diff.bestMatch(candidates)
+    check(index == 1)
+    check(similarity == 0.75)
+    check(similarity == newDiff(candidates[1], target).ratio())
+    check(diff.bestMatch(newSeq[seq[string]]()) == (-1, 0.0))
+    check(len(diff.a) == 0)
+
+  test "86":
+    var lines = newSeq[string]()
+    for i in 1 .. 20:
+      lines.add(&"line {i}")
+    let a = lines.join("\n") & "\n"
+    lines[1] = "LINE 2"
+    let b = lines.join("\n") & "\n"
+    check(diffText(a, b, showHidden = true) ==
+          @["@@ -1,5 +1,5 @@", " line 1", "-line 2", "+LINE 2", " line 3",
+            " line 4", " line 5", "(15 lines below)"])
+    check(newDiff(splitLinesKeepEnds(a),
+                  splitLinesKeepEnds(b)).hiddenLines() == (0, 15))
+    lines[1] = "line 2"
+    lines[9] = "LINE 10"
+    let c = lines.join("\n") & "\n"
+    check(newDiff(splitLinesKeepEnds(a),
+                  splitLinesKeepEnds(c)).hiddenLines(2) == (7, 8))
+    let shown = diffText(a, c, context = 2, showHidden = true)
+    check(shown[0] == "(7 lines above)")
+    check(shown[^1] == "(8 lines below)")
+    check(len(diffText(a, a, showHidden = true)) == 0)
+
+  test "87":
+    let a = @[Account(id: 1, owner: "Ann"), Account(id: 2, owner: "Bob")]
+    let b = @[Account(id: 1, owner: "Anne"), Account(id: 3, owner: "Cy")]
+    let diff = newKeyedDiff(a, b)
+    check(diff.a == @["1", "2"])
+    check(toSeq(diff.spans()) == @[newSpan(tagEqual, 0, 1, 0, 1),
+                                   newSpan(tagReplace, 1, 2, 1, 2)])
+    check(Account is Keyed)
+    check(not (int is Keyed))
+
+  test "88":
+    let a = "one two three".split()
+    check(newDiff(a, a).kind() == kindIdentical)
+    check(newDiff(newSeq[string](), newSeq[string]()).kind() ==
+          kindIdentical)
+    check(newDiff(a, "zero one two two and a half three".split()).kind() ==
+          kindPureInsert)
+    check(newDiff(newSeq[string](), a).kind() == kindPureInsert)
+    check(newDiff(a, "one three".split()).kind() == kindPureDelete)
+    check(newDiff(a, "one 2 three".split()).kind() == kindMixed)
+    check(newDiff(a, "zero one three".split()).kind() == kindMixed)
+    check($kindPureInsert == "pure insert")
+
+  test "89":
+    proc scanner(text: string): Scanner[string] =
+      let tokens = text.split()
+      var i = 0
+      result = proc(): tuple[item: string, ok: bool] =
+        if i < len(tokens):
+          result = (tokens[i], true)
+          inc i
+    let diff = newScannerDiff(scanner("a b c d"), scanner("a x c d e"))
+    check(diff.a == @["a", "b", "c", "d"])
+    check(toSeq(diff.spans()) ==
+          toSeq(newDiff("a b c d".split(), "a x c d e".split()).spans()))
+    check(len(newScannerDiff(scanner("a b"), scanner("b"),
+                             maxItems = 2).b) == 1)
+    expect(ValueError):
+      discard newScannerDiff(scanner("a b c"), scanner("b"), maxItems = 2)
+
+  test "90":
+    let a = "the cat sat on the mat".split()
+    let b = "the dog ran by one pond".split()
+    check(toSeq(newDiff(a, b).spans(skipEqual = true)) ==
+          @[newSpan(tagReplace, 1, 6, 1, 6)])
+    check(toSeq(newDiff(a, b, replaceThreshold = 0.5).spans(
+          skipEqual = true)) == @[newSpan(tagDelete, 1, 6, 1, 1),
+                                  newSpan(tagInsert, 6, 6, 1, 6)])
+    # exceeding maxWork gives a single replacement of similar items
+    let c = "the cat sat on the mat today".split()
+    let d = "the cat sat on a mat now".split()
+    check(toSeq(newDiff(c, d, maxWork = 1,
+                        replaceThreshold = 0.5).spans()) ==
+          @[newSpan(tagReplace, 0, 7, 0, 7)])
+    # so the work done is no more than without replaceThreshold
+    var hashCount = 0
+    proc counted(item: string): Hash =
+      inc hashCount
+      hash(item)
+    let e = sequtils.repeat("x", 300)
+    discard toSeq(newDiff(e, e, autoJunk = false, maxWork = 1000,
+                          hasher = counted).spans())
+    let limitedHashes = hashCount
+    hashCount = 0
+    let limited = newDiff(e, e, autoJunk = false, maxWork = 1000,
+                          hasher = counted, replaceThreshold = 0.5)
+    check(toSeq(limited.spans()) == @[newSpan(tagReplace, 0, 300, 0, 300)])
+    check(hashCount == limitedHashes)
+
+  test "91":
+    check(displayWidth("") == 0)
+    check(displayWidth("abc") == 3)
+    check(displayWidth("日本語") == 6)
+    check(displayWidth("ｘｙ") == 4) # fullwidth
+    check(displayWidth("é") == 1) # e + combining acute accent
+    check(intralineMarks("a日b", "a本b") == (" ^^ ", " ^^ "))
+    check(intralineMarks("ab日", "xb日") == ("^   ", "^   "))
+    let a = @["名前 = x\n", "size = 10\n", "id = 1\n"]
+    let b = @["名前 = y\n", "size = 10\n", "id = 1\n"]
+    let lines = toSeq(unifiedDiff(a, b, alignColumns = true))
+    check(lines == @["--- a\n", "+++ b\n", "@@ -1,3 +1,3 @@\n",
+                     "-名前 = x\n", "+名前 = y\n", " size = 10\n",
+                     " id   = 1\n"])
+    for line in lines[3 .. ^1]:
+      check(displayWidth(line.split('=')[0]) == 6)
+
+  test "92":
+    let base = "a b c d e f".split()
+    let v1 = "a B c d E f".split()
+    let v2 = "a B c d f g".split()
+    check(interdiff(base, v1, v2) == @[
+      newSpanSlice(tagEqual, @["@@ -2 @@", "-b", "+B", "@@ -5 @@", "-e"],
+                   @["@@ -2 @@", "-b", "+B", "@@ -5 @@", "-e"]),
+      newSpanSlice(tagReplace, @["+E"], @["@@ -6,0 @@", "+g"])])
+    check(interdiff(base, v1, v1).allIt(it.tag == tagEqual))
+    check(len(interdiff(base, base, base)) == 0)
+
+  test "93":
+    let diff = newDiff("a b c d e".split(), "a X c Y e".split())
+    proc encoder(overhead: int): proc(spans: seq[Span]): int =
+      result = proc(spans: seq[Span]): int =
+        for span in spans:
+          if span.tag != tagEqual:
+            result += overhead + span.bEnd - span.bStart
+    check(diff.minimizePatchBytes(encoder(10)) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),
+            newSpan(tagReplace, 1, 4, 1, 4),
+            newSpan(tagEqual, 4, 5, 4, 5)])
+    check(diff.minimizePatchBytes(encoder(1)) == toSeq(diff.spans()))
+    let spans = toSeq(newDiff("a b c d e f g".split(),
+                              "A b C d E f g".split()).spans())
+    check(minimizePatchBytes(spans, encoder(10)) ==
+          @[newSpan(tagReplace, 0, 5, 0, 5),
+            newSpan(tagEqual, 5, 7, 5, 7)])
+
+  test "94":
+    let a = "foo\nbar\nbaz\nquux".split('\n')
+    let b = "foo\nbaz\nbar\nquux".split('\n')
+    let swaps = newDiff(a, b).detectSwaps()
+    check(swaps == @[(newSpan(tagEqual, 0, 1, 0, 1), -1),  # foo
+                     (newSpan(tagInsert, 1, 1, 1, 2), 3),  # -> baz
+                     (newSpan(tagEqual, 1, 2, 2, 3), -1),  # bar
+                     (newSpan(tagDelete, 2, 3, 3, 3), 1),  # baz ->
+                     (newSpan(tagEqual, 3, 4, 3, 4), -1)]) # quux
+    let trailing = newDiff(a, b, boundary = boundaryTrailing)
+    check(trailing.detectSwaps().mapIt(it.moved) == @[-1, 3, -1, 1, -1])
+    check(newDiff(a, b).detectSwaps(window = 0).allIt(it.moved == -1))
+    let c = "foo bar baz quux".split()
+    let d = "foo new bar quux".split()
+    check(newDiff(c, d).detectSwaps().allIt(it.moved == -1))
+
+  test "95":
+    let a = @["one\n", "two\n"]
+    check(len(toSeq(unifiedDiff(a, a))) == 0)
+    check(toSeq(unifiedDiff(a, a, emptyMessage = "Files are identical")) ==
+          @["Files are identical\n"])
+    check(toSeq(unifiedDiff(a, a, emptyMessage = "Same\n")) == @["Same\n"])
+    check(toSeq(unifiedDiff(@[1, 2], @[1, 2], formatDollar[int],
+                            emptyMessage = "Same")) == @["Same\n"])
+    let b = @["one\n", "three\n"]
+    check(toSeq(unifiedDiff(a, b, emptyMessage = "Same")) ==
+          toSeq(unifiedDiff(a, b)))
+    check(len(diffText("x\ny\n", "x\ny\n")) == 0)
+    check(diffText("x\ny\n", "x\ny\n", emptyMessage = "No changes") ==
+          @["No changes"])
+    check(diffText("x\n", "y\n", emptyMessage = "No changes") ==
+          diffText("x\n", "y\n"))
+
+  test "96":
+    let flag = "\u{1F1EB}\u{1F1F7}" # France
+    check(htmlInline("Hello world", &"Hello {flag} world") ==
+          &"Hello <ins>{flag} </ins>world")
+    let finland = "\u{1F1EB}\u{1F1EE}" # shares its first rune with France
+    check(htmlInline(&"I ❤ {flag}", &"I ❤ {finland}") ==
+          &"I ❤ <del>{flag}</del><ins>{finland}</ins>")
+    check(htmlInline("a < b", "a <= b") == "a &lt;<ins>=</ins> b")
+    check(htmlInline("x & y", "x & y") == "x &amp; y")
+    check(htmlInline("cafe\u0301", "cafe") ==
+          "caf<del>e\u0301</del><ins>e</ins>")
+    check(intralineMarks(&"a{flag}", &"a{finland}") == (" ^^", " ^^"))
+
+  test "97":
+    let a = @["head", "alpha one", "beta two", "gamma three", "tail"]
+    let b = @["head", "alpha 1ne", "new line x", "beta tw0",
+              "gamma thr33", "zzz", "tail"]
+    let rows = newDiff(a, b).alignedRows()
+    check(rows == @[(some("head"), some("head")),
+                    (some("alpha one"), some("alpha 1ne")),
+                    (none(string), some("new line x")),
+                    (some("beta two"), some("beta tw0")),
+                    (some("gamma three"), some("gamma thr33")),
+                    (none(string), some("zzz")),
+                    (some("tail"), some("tail"))])
+    check(rows.countIt(it.left.isNone()) == 2)
+    check(newDiff(@["x", "y"], @["y"]).alignedRows() ==
+          @[(some("x"), none(string)), (some("y"), some("y"))])
+
+  test "98":
+    var b = newSeq[string]()
+    for i in 0 ..< 300:
+      b.add(["x", "y"][i mod 2])
+    var a = b
+    a[0] = "w"
+    # Every item is popular so nothing can be matched
+    check(toSeq(newDiff(a, b).spans()) ==
+          @[newSpan(tagReplace, 0, 300, 0, 300)])
+    let fallback = newDiff(a, b, autoJunkFallback = true)
+    check(fallback.popularElements() == @["x", "y"])
+    check(toSeq(fallback.spans()) ==
+          @[newSpan(tagReplace, 0, 1, 0, 1),
+            newSpan(tagEqual, 1, 300, 1, 300)])
+    check(fallback.ratio() > 0.99)
+    check(toSeq(fallback.lazyMatches()) == fallback.matches())
+    check(fallback.firstHunks(1).hunks == fallback.hunks())
+    let c = "a b c".split()
+    check(toSeq(newDiff(c, c, autoJunkFallback = true).spans()) ==
+          @[newSpan(tagEqual, 0, 3, 0, 3)])
+
+  test "99":
+    check(parseVersion("1.2.3") == (1, 2, 3))
+    check(parseVersion("0.10") == (0, 10, 0))
+    check(versionInfo() == parseVersion(Version))
+    let (major, minor, _) = versionInfo()
+    check(major > 0 or minor >= 5)
+    # Version is a copy of diff.nimble's so must be kept in step with it
+    const nimble = staticRead("../diff.nimble")
+    let versions = nimble.splitLines().filterIt(it.startsWith("version"))
+    check(len(versions) == 1 and versions[0].split('"')[1] == Version)
+    for version in ["", "1", "1.2.3.4", "1.x.3", "1..3", "-1.2.3",
+                    "v1.2.3", "1.2.3-beta"]:
+      expect(ValueError):
+        discard parseVersion(version)
+
+  test "100":
+    proc placeName(place: Place): string = place.name
+    proc placeX(place: Place): int = place.x
+    let a = @[Place(x: 1, y: 0, name: "A")]
+    let b = @[Place(x: 5, y: 0, name: "A"), Place(x: 1, y: 0, name: "A")]
+    check(toSeq(newKeyDiff(a, b, placeName).spans()) ==
+          @[newSpan(tagEqual, 0, 1, 0, 1),
+            newSpan(tagInsert, 1, 1, 1, 2)])
+    check(toSeq(newKeyDiff(a, b, placeName, placeX).spans()) ==
+          @[newSpan(tagInsert, 0, 0, 0, 1),
+            newSpan(tagEqual, 0, 1, 1, 2)])
+    let c = @[Place(x: 1, y: 0, name: "A"), Place(x: 2, y: 0, name: "A")]
+    let d = @[Place(x: 0, y: 0, name: "A"), Place(x: 1, y: 0, name: "A"),
+              Place(x: 2, y: 0, name: "A")]
+    check(toSeq(newKeyDiff(c, d, placeName).spans()) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2),
+            newSpan(tagInsert, 2, 2, 2, 3)])
+    var diff = newKeyDiff(c, d, placeName, placeX)
+    check(toSeq(diff.spans()) ==
+          @[newSpan(tagInsert, 0, 0, 0, 1),
+            newSpan(tagEqual, 0, 2, 1, 3)])
+    diff.replaceB(0, "A") # discards the tie-break keys
+    check(toSeq(diff.spans()) ==
+          toSeq(newKeyDiff(c, d, placeName).spans()))
+    let tied = newKeyDiff(c, d, placeName, placeX)
+    check(tied.bestMatch(@[@["A"], @["A", "A", "A"]]) == (1, 1.0))
+    check(tied.bestMatch(@[@["A", "A", "A", "A"]]).index == 0)
+
+  test "101":
+    let a = toSeq(1 .. 20).mapIt($it)
+    var b = a
+    b[1] = "two"
+    b.delete(17)
+    let stream = newStringStream()
+    newDiff(a, b).writeJsonHunks(stream)
+    let hunks = parseJson(stream.data)
+    check(len(hunks) == 2)
+    check(hunks[0]["aStart"].getInt() == 1)
+    check(hunks[0]["aCount"].getInt() == 5)
+    check(hunks[0]["bStart"].getInt() == 1)
+    check(hunks[0]["bCount"].getInt() == 5)
+    check(toSeq(hunks[0]["lines"].items()).mapIt(it["tag"].getStr()) ==
+          @["equal", "delete", "insert", "equal", "equal", "equal"])
+    check(hunks[0]["lines"][2] == %*{"tag": "insert", "content": "two"})
+    check(hunks[1]["aStart"].getInt() == 15)
+    check(hunks[1]["aCount"].getInt() == 6)
+    check(hunks[1]["bStart"].getInt() == 15)
+    check(hunks[1]["bCount"].getInt() == 5)
+    check(toSeq(hunks[1]["lines"].items()).mapIt(it["content"].getStr()) ==
+          @["15", "16", "17", "18", "19", "20"])
+    let same = newStringStream()
+    newDiff(a, a).writeJsonHunks(same)
+    check(same.data == "[]")
+
+  test "102":
+    proc placeName(place: Place): string = place.name
+    let a = @[Place(x: 1, y: 2, name: "A"), Place(x: 5, y: 5, name: "B"),
+              Place(x: 3, y: 3, name: "C")]
+    let b = @[Place(x: 1, y: 9, name: "A"), Place(x: 5, y: 5, name: "B"),
+              Place(x: 3, y: 3, name: "D"), Place(x: 0, y: 0, name: "E")]
+    let changes = diffRecords(a, b, placeName, placeFields)
+    check(changes.added == @["D", "E"])
+    check(changes.removed == @["C"])
+    check(len(changes.changed) == 1)
+    check(changes.changed[0].key == "A")
+    check(toSeq(changes.changed[0].fields.pairs()) == @[("y", ("2", "9"))])
+    # Duplicate keys: the unmatched extra occurrence is removed
+    let c = @[Place(x: 1, y: 1, name: "A"), Place(x: 2, y: 2, name: "A")]
+    let duplicates = diffRecords(c, c[0 .. 0], placeName, placeFields)
+    check(duplicates.removed == @["A"])
+    check(len(duplicates.added) == 0)
+    check(len(duplicates.changed) == 0)
+
+  test "103":
+    let a = @["Hello", "World", "Foo"]
+    let b = @["hello", "WORLD", "Bar", "foo "]
+    proc folded(line: string): string = line.strip().toLowerAscii()
+    let diff = newTransformedDiff(a, b, folded)
+    check(toSeq(diff.spans()) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2), newSpan(tagInsert, 2, 2, 2, 3),
+            newSpan(tagEqual, 2, 3, 3, 4)])
+    check(toSeq(diff.spanSlices()) ==
+          @[newSpanSlice(tagEqual, @["Hello", "World"],
+                         @["hello", "WORLD"]),
+            newSpanSlice(tagInsert, newSeq[string](), @["Bar"]),
+            newSpanSlice(tagEqual, @["Foo"], @["foo "])])
+    check(diff.keys.a == @["hello", "world", "foo"])
+    check(diff.keys.ratio() > 0.85)
+
+  test "104":
+    let a = "a b c d".split()
+    let diff = newDiff(a, "a x c d".split())
+    check(apply(a, diff.toPatch()) == diff.b)
+    proc equal(aStart, aEnd: int): PatchItem[string] =
+      (newSpan(tagEqual, aStart, aEnd, aStart, aEnd), newSeq[string]())
+    proc failure(patch: Patch[string]): (int, string) =
+      try:
+        discard apply(a, patch)
+      except PatchError as error:
+        result = (error.index, error.msg)
+    check(failure(@[equal(0, 1), equal(2, 4)]) ==
+          (1, "invalid patch span 1: gap at 1"))
+    check(failure(@[equal(0, 2), equal(1, 4)]) ==
+          (1, "invalid patch span 1: overlaps at 1"))
+    check(failure(@[equal(0, 2), equal(2, 5)]) ==
+          (1, "invalid patch span 1: out of range 2..<5"))
+    check(failure(@[equal(0, 2), equal(2, 4), equal(1, 2)]) ==
+          (2, "invalid patch span 2: not in order"))
+    check(failure(@[equal(0, 2)]) == (1, "invalid patch span 1: gap at 2"))
+    var patch = diff.toPatch()
+    patch[1].span = newSpan(tagInsert, 1, 2, 1, 2)
+    check(failure(patch) ==
+          (1, "invalid patch span 1: insert span with items of a"))
+    patch[1].span = newSpan(tagDelete, 1, 2, 1, 1)
+    check(failure(patch) ==
+          (1, "invalid patch span 1: delete has 1 items instead of 0"))
+    patch[1] = (newSpan(tagReplace, 1, 2, 1, 3), @["x"])
+    check(failure(patch) ==
+          (1, "invalid patch span 1: replace has 1 items instead of 2"))
+    let stream = newStringStream()
+    diff.writePatch(stream, encodeString)
+    for size in 0 ..< len(stream.data):
+      expect(ValueError):
+        discard readPatch[string](newStringStream(stream.data[0 ..< size]),
+                                  decodeString)
+    let corrupt = newStringStream("DIFP\x01\x01\x02\x00\x00\x00\x00" &
+                                  "\x01\xFF\xFF\xFF\xFF\x0F")
+    expect(ValueError):
+      discard readPatch[string](corrupt, decodeString)
+    expect(ValueError):
+      discard apply(newSeq[string](), diff.toPatch())
+
+  test "105":
+    let slices = toSeq(spanSlices("a b c d".split(), "a x c".split()))
+    check(compactSlices(slices) == slices)
+    let nothing = newSeq[string]()
+    let sparse = @[newSpanSlice(tagEqual, @["a"], @["a"]),
+                   newSpanSlice(tagEqual, nothing, nothing),
+                   newSpanSlice(tagDelete, nothing, nothing),
+                   newSpanSlice(tagInsert, @["x"], nothing),
+                   newSpanSlice(tagReplace, nothing, nothing),
+                   newSpanSlice(tagReplace, nothing, @["y"]),
+                   newSpanSlice(tagInsert, nothing, @["z"])]
+    let compact = compactSlices(sparse)
+    check(compact == @[sparse[0], sparse[5], sparse[6]])
+    for slice in compact:
+      check(len(slice.a) + len(slice.b) > 0)
+
+  test "106":
+    let a = "foo\nbar\nbaz\nquux".split('\n')
+    let b = "foo\nbaz\nbar\nquux".split('\n')
+    let diff = newDiff(a, b)
+    let spans = toSeq(diff.spans())
+    check(diff.explainSpan(spans[0]) == "equal: a[0..<1] = b[0..<1] is " &
+          "(part of) a match")
+    check(diff.explainSpan(spans[1]) == "insert: between the match " &
+          "a[0..<1] = b[0..<1] and the match a[1..<2] = b[2..<3], only " &
+          "b has unmatched items (b[1..<2]), so they are inserted")
+    check(diff.explainSpan(spans[3]) == "delete: between the match " &
+          "a[1..<2] = b[2..<3] and the match a[3..<4] = b[3..<4], only " &
+          "a has unmatched items (a[2..<3]), so they are deleted")
+    let other = newDiff("a b".split(), "x y z".split())
+    check(other.explainSpan(toSeq(other.spans())[0]) == "replace: " &
+          "between the start and the end, both a (a[0..<2]) and b " &
+          "(b[0..<3]) have unmatched items, so a's are replaced by b's")
+
+  test "107":
+    let diff = newDiff(@["a\n", "b\n", "c\n"], @["a\n", "x\n", "c\n"])
+    let summary: Formatter[string] = proc(stream: Stream,
+                                          diff: Diff[string]) =
+      let counts = diff.opCounts()
+      stream.write(&"{counts.replaces} replaced, " &
+                   &"{counts.inserts} inserted, {counts.deletes} deleted")
+    var formatters = initOrderedTable[string, Formatter[string]]()
+    formatters["summary"] = summary
+    formatters["unified"] = unifiedFormatter(context = 1)
+    formatters["dot"] = dotFormatter[string]()
+    var outputs = newSeq[string]()
+    for formatter in formatters.values():
+      let stream = newStringStream()
+      diff.writeFormatted(stream, formatter)
+      outputs.add(stream.data)
+    check(outputs[0] == "1 replaced, 0 inserted, 0 deleted")
+    check(outputs[1] == toSeq(unifiedDiff(diff.a, diff.b,
+                                          context = 1)).join())
+    let dot = newStringStream()
+    diff.writeDot(dot)
+    check(outputs[2] == dot.data)
+    let jsonOutput = newStringStream()
+    diff.writeFormatted(jsonOutput, jsonFormatter())
+    check(parseJson(jsonOutput.data)[0]["aCount"].getInt() == 3)
+    let same = newStringStream()
+    let identical = unifiedFormatter(emptyMessage = "Files are identical")
+    newDiff(diff.a, diff.a).writeFormatted(same, identical)
+    check(same.data == "Files are identical\n")
+    # The formatters use the given diff, so agree for non-default options
+    let trailing = newDiff(@["a\n", "b\n"], @["a\n", "b\n", "a\n", "b\n"],
+                           boundary = boundaryTrailing)
+    let unified = newStringStream()
+    trailing.writeFormatted(unified, unifiedFormatter())
+    check(unified.data == "--- a\n+++ b\n@@ -1,2 +1,4 @@\n" &
+                          "+a\n+b\n a\n b\n")
+    let trailingJson = newStringStream()
+    trailing.writeFormatted(trailingJson, jsonFormatter())
+    let prefixes = {"equal": " ", "delete": "-", "insert": "+"}.toTable()
+    var expected = newSeq[string]()
+    for line in parseJson(trailingJson.data)[0]["lines"]:
+      expected.add(prefixes[line["tag"].getStr()] &
+                   line["content"].getStr())
+    check(splitLinesKeepEnds(unified.data)[3 .. ^1] == expected)
+
+  test "108":
+    var diff = newDiff("a b c d e".split(), "a x c e f".split())
+    let spans = toSeq(diff.spans())
+    check(diff.spanCount() == len(spans))
+    for i in countdown(len(spans) - 1, 0):
+      check(diff.spanAt(i) == spans[i])
+    diff.replaceB(1, "b")
+    let edited = toSeq(diff.spans())
+    check(edited != spans)
+    check(diff.spanCount() == len(edited))
+    for i in 0 ..< diff.spanCount():
+      check(diff.spanAt(i) == edited[i])
+    var same = newDiff(@[1, 2], @[1, 2])
+    check(same.spanCount() == 1)
+    check(same.spanAt(0) == newSpan(tagEqual, 0, 2, 0, 2))
+
+  test "109":
+    proc place(x: int, name: string): ref Place =
+      result = new(Place)
+      result[] = Place(x: x, y: 0, name: name)
+    let a = @[place(1, "A"), nil, place(2, "B")]
+    let b = @[place(1, "A"), place(3, "C"), place(2, "B")]
+    check(a[0] != b[0]) # different refs to equal values
+    let diff = newRefDiff(a, b)
+    check(toSeq(diff.spans(skipEqual = true)) ==
+          @[newSpan(tagReplace, 1, 2, 1, 2)]) # nil -> C
+    check(diff.a[1].isNone())
+    check(toSeq(newRefDiff(@[a[1], a[0]], @[a[1], b[0]]).spans()) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2)])
+    var x = Place(x: 1, y: 0, name: "A")
+    var y = x
+    check(toSeq(newPtrDiff(@[addr x, nil], @[addr y, nil]).spans()) ==
+          @[newSpan(tagEqual, 0, 2, 0, 2)])
+
+  test "110":
+    let a = @["start", "alpha beta", "junk", "gamma delta", "end"]
+    let b = @["start", "alpha betta", "gamma delta!", "end"]
+    check(toSeq(pairedSpanSlices(a, b, maxPairing = 3)) ==
+          toSeq(pairedSpanSlices(a, b)))
+    check(toSeq(pairedSpanSlices(a, b, maxPairing = 2)) ==
+          @[newSpanSlice(tagEqual, @["start"], @["start"]),
+            newSpanSlice(tagDelete, a[1 .. 3], newSeq[string]()),
+            newSpanSlice(tagInsert, newSeq[string](), b[1 .. 2]),
+            newSpanSlice(tagEqual, @["end"], @["end"])])
+    # Pairing these would need 4 million line comparisons
+    let c = toSeq(0 ..< 2000).mapIt(&"old line {it}")
+    let d = toSeq(0 ..< 2000).mapIt(&"new line {it}")
+    let slices = toSeq(pairedSpanSlices(c, d, maxPairing = 100))
+    check(slices == @[newSpanSlice(tagDelete, c, newSeq[string]()),
+                      newSpanSlice(tagInsert, newSeq[string](), d)])
+    let rows = newDiff(c, d).alignedRows(maxPairing = 100)
+    check(len(rows) == 4000)
+    check(rows[0] == (some("old line 0"), none(string)))
+    check(rows[2000] == (none(string), some("new line 0")))
+
+  test "111":
+    let base = "a b c d e f g".split()
+    let mine = "a B c d e F g".split()
+    let theirs = "a B c D e X g".split()
+    let (merged, conflicts) = merge3(base, mine, theirs)
+    check(merged == "a B c D e g".split())
+    check(conflicts == @[(5, @["f"], @["F"], @["X"])])
+    let fromDiffs = merge3(newDiff(base, mine), newDiff(base, theirs))
+    check(fromDiffs.merged == merged)
+    check(fromDiffs.conflicts == conflicts)
+    # Clean: changes to separate parts, including an insertion
+    let clean = merge3(base, "a b c d e f g h".split(),
+                       "A b c d e f g".split())
+    check(clean.merged == "A b c d e f g h".split())
+    check(len(clean.conflicts) == 0)
+    # Adjacent changes conflict
+    let adjacent = merge3(base, "a b x d e f g".split(),
+                          "a b c y e f g".split())
+    check(adjacent.merged == "a b e f g".split())
+    check(adjacent.conflicts == @[(2, @["c", "d"], @["x", "d"],
+                                   @["c", "y"])])
+    expect(ValueError):
+      discard merge3(newDiff(base, mine), newDiff(mine, theirs))
+
+  test "112":
+    let a = "a b c d".split()
+    check(commonPrefixLen(a, a) == 4)
+    check(commonSuffixLen(a, a) == 4)
+    let disjoint = "w x y z".split()
+    check(commonPrefixLen(a, disjoint) == 0)
+    check(commonSuffixLen(a, disjoint) == 0)
+    check(commonPrefixLen(a, "a b x d".split()) == 2)
+    check(commonSuffixLen(a, "a b x d".split()) == 1)
+    check(commonPrefixLen(a, newSeq[string]()) == 0)
+    # The prefix and suffix overlap
+    let b = "a b a".split()
+    let c = "a b a b a".split()
+    check(commonPrefixLen(b, c) == 3)
+    check(commonSuffixLen(b, c) == 3)
+    check(min(commonSuffixLen(b, c),
+              min(len(b), len(c)) - commonPrefixLen(b, c)) == 0)
+
+  test "113":
+    let a = toSeq(1 .. 30).mapIt(&"{it}\n")
+    var b = a
+    b.insert("new\n", 0)
+    b[10] = "ten\n"
+    b.delete(20 .. 21)
+    b.add("end\n")
+    let diffHunks = newDiff(a, b).hunks(context = 2)
+    check(len(diffHunks) == 4)
+    check(diffHunks[0].header == (1, 2, 1, 3))
+    proc headerRange(start, count: int): string =
+      if count == 1: $start else: &"{start},{count}"
+    var headers = newSeq[string]()
+    for line in unifiedDiff(a, b, context = 2):
+      if line.startsWith("@@"):
+        headers.add(line)
+    check(len(headers) == len(diffHunks))
+    for (i, hunk) in diffHunks.pairs():
+      let (aStart, aCount, bStart, bCount) = hunk.header
+      check(headers[i] == &"@@ -{headerRange(aStart, aCount)} " &
+            &"+{headerRange(bStart, bCount)} @@\n")
+      check(hunk.spans.anyIt(it.tag != tagEqual))
+
+  test "114":
+    var a = @["# Generated 2019-12-01\n"]
+    for i in 1 .. 10:
+      a.add(&"line {i}\n")
+    var b = a
+    b[0] = "# Generated 2020-01-15\n"
+    b[8] = "# Generated by hand\n" # mixed with a real change
+    b.insert("LINE\n", 9)
+    let generated = (line: string) => line.startsWith("# Generated")
+    let lines = toSeq(unifiedDiff(a, b, context = 1,
+                                  ignoreLine = generated))
+    check(lines == @["--- a\n", "+++ b\n", "@@ -8,3 +8,4 @@\n",
+                     " line 7\n", "-line 8\n", "+# Generated by hand\n",
+                     "+LINE\n", " line 9\n"])
+    let unfiltered = toSeq(unifiedDiff(a, b, context = 1))
+    check(unfiltered[2] == "@@ -1,2 +1,2 @@\n")
+    check(unfiltered[6 .. ^1] == lines[2 .. ^1])
+    check(len(toSeq(unifiedDiff(a[0 .. 1], b[0 .. 1],
+                                ignoreLine = generated))) == 0)
+
+  test "115":
+    check(Tags == [tagEqual, tagInsert, tagDelete, tagReplace])
+    check(Tags.mapIt($it) == @["equal", "insert", "delete", "replace"])
+    check(Tags.allIt(it.isValid()))
+    let invalid = cast[Tag](7'u8)
+    check(not invalid.isValid())
+    check($invalid == "Tag(7)")
+    check(&"{tagReplace}" == "replace")
+    var counts: array[Tag, int]
+    for span in spans("a b c".split(), "a x c d".split()):
+      inc counts[span.tag]
+    check(counts == [2, 1, 0, 1])
+
+  test "116":
+    let a = toSeq(1 .. 30).mapIt($it)
+    var b = a
+    for i in [2, 8, 14, 20, 26]:
+      b[i] = "changed"
+    let diff = newDiff(a, b)
+    let every = diff.hunks(context = 1)
+    check(len(every) == 5)
+    let (first, more) = diff.firstHunks(2, context = 1)
+    check(first == every[0 .. 1])
+    check(more == 3)
+    let (_, atLeast) = diff.firstHunks(2, context = 1, exact = false)
+    check(atLeast == 1)
+    check(diff.firstHunks(5, context = 1) == (every, 0))
+    check(diff.firstHunks(5, context = 1, exact = false) == (every, 0))
+    for context in 0 .. 4:
+      check(diff.firstHunks(10, context).hunks == diff.hunks(context))
+    check(newDiff(a, a).firstHunks(2) == (newSeq[Hunk](), 0))
+    let split = newDiff(a, b, replaceThreshold = 0.5)
+    let splitHunks = split.hunks(context = 1)
+    check(splitHunks[0].spans.filterIt(it.tag != tagEqual) ==
+          @[newSpan(tagDelete, 2, 3, 2, 2),
+            newSpan(tagInsert, 3, 3, 2, 3)])
+    check(split.firstHunks(2, context = 1) == (splitHunks[0 .. 1], 3))
+
+  test "117":
+    # Round trip: the slices of line diffs reproduce both texts exactly
+    var rng = initRand(917)
+    proc randomText(rng: var Rand): string =
+      for _ in 0 ..< rng.rand(12):
+        result.add(rng.sample(["x", "y", "z\n", "\n", "\r\n", " ", "é"]))
+    for _ in 0 ..< 500:
+      let a = randomText(rng)
+      let b = randomText(rng)
+      let slices = toSeq(spanSlices(splitLinesKeepEnds(a),
+                                    splitLinesKeepEnds(b)))
+      check(slices.mapIt(it.a.join()).join() == a)
+      check(slices.mapIt(it.b.join()).join() == b)
+      check(applySlices(slices).join() == b)
+    let slices = toSeq(spanSlices(splitLinesKeepEnds("a\nb\n"),
+                                  splitLinesKeepEnds("a\nb")))
+    check(slices == @[newSpanSlice(tagEqual, @["a\n"], @["a\n"]),
+                      newSpanSlice(tagReplace, @["b\n"], @["b"])])
+
+  test "118":
+    type
+      LogLineV1 = object
+        message: string
+      LogLineV2 = object
+        level: int
+        text: string
+    proc messageV1(line: LogLineV1): string = line.message
+    proc messageV2(line: LogLineV2): string = line.text
+    let a = @[LogLineV1(message: "start"), LogLineV1(message: "load"),
+              LogLineV1(message: "stop")]
+    let b = @[LogLineV2(level: 1, text: "start"),
+              LogLineV2(level: 2, text: "warn"),
+              LogLineV2(level: 1, text: "load"),
+              LogLineV2(level: 1, text: "stop")]
+    let diff = newProjectedDiff(a, b, messageV1, messageV2)
+    let spans = toSeq(diff.spans())
+    check(spans == @[newSpan(tagEqual, 0, 1, 0, 1),
+                     newSpan(tagInsert, 1, 1, 1, 2),
+                     newSpan(tagEqual, 1, 3, 2, 4)])
+    check(diff.b[spans[1].bStart].level == 2)
+    for span in diff.spans(skipEqual = false):
+      if span.tag == tagEqual:
+        for k in 0 ..< span.aEnd - span.aStart:
+          check(diff.a[span.aStart + k].message ==
+                diff.b[span.bStart + k].text)
+
+  test "119":
+    let diff = newDiff(toSeq("qabxcd"), toSeq("abycdf"))
+    let steps = diff.transitions()
+    check(steps == @[('q', transitionRemove, 0, -1),
+                     ('a', transitionKeep, 1, 0),
+                     ('b', transitionKeep, 2, 1),
+                     ('x', transitionRemove, 3, -1),
+                     ('y', transitionAdd, -1, 2),
+                     ('c', transitionKeep, 4, 3),
+                     ('d', transitionKeep, 5, 4),
+                     ('f', transitionAdd, -1, 5)])
+    for transition in steps:
+      case transition.kind
+      of transitionKeep:
+        check(diff.a[transition.fromIndex] == diff.b[transition.toIndex])
+      of transitionAdd:
+        check(transition.fromIndex == -1 and transition.toIndex > -1)
+      of transitionRemove:
+        check(transition.fromIndex > -1 and transition.toIndex == -1)
+    check(steps.mapIt(it.kind == transitionKeep) ==
+          diff.operations().mapIt(it.tag == tagEqual))
+
+  test "120":
+    let a = @["proc f() =\n", "  if x:\n", "    y()\n", "  z()\n"]
+    let b = @["proc f() =\n", "    if x:\n", "\ty()\n", "    w()\n"]
+    check(indentInsensitiveSpans(a, b) ==
+          @[(newSpan(tagEqual, 0, 1, 0, 1), false),   # proc f() =
+            (newSpan(tagEqual, 1, 3, 1, 3), true),    # if x: y()
+            (newSpan(tagReplace, 3, 4, 3, 4), false)]) # z() -> w()
+    check(toSeq(newDiff(a, b).spans()).filterIt(it.tag != tagEqual) ==
+          @[newSpan(tagReplace, 1, 4, 1, 4)])
+    check(indentInsensitiveSpans(a, @["proc f() = \n"]) ==
+          @[(newSpan(tagReplace, 0, 4, 0, 1), false)])
+
+  test "121":
+    var rng = initRand(421)
+    var diff = newDiff(newSeq[int](), newSeq[int]())
+    for size in [0, 3, 10, 250, 5, 400, 1]:
+      let a = toSeq(0 ..< size).mapIt(rng.rand(5))
+      let b = toSeq(0 ..< size + 2).mapIt(rng.rand(5))
+      diff.setSeqs(a, b)
+      let fresh = newDiff(a, b)
+      check(diff.a == a and diff.b == b)
+      check(diff.matches() == fresh.matches())
+      check(toSeq(diff.spans()) == toSeq(fresh.spans()))
+      check(diff.popularElements() == fresh.popularElements())
+    var strict = newDiff(@[1, 2], @[2, 1], autoJunk = false)
+    let b = toSeq(0 ..< 300).mapIt(it mod 2)
+    strict.setSeqs(@[1], b)
+    check(len(strict.popularElements()) == 0)
+    check(strict.matches() == newDiff(@[1], b, autoJunk = false).matches())
+
+  test "122":
+    let diff = newDiff(toSeq("xabycdz"), toSeq("abqcdw"))
+    check(diff.anchoredChanges() ==
+          @[(newSpan(tagDelete, 0, 1, 0, 0), none(char), some('a')),
+            (newSpan(tagReplace, 3, 4, 2, 3), some('b'), some('c')),
+            (newSpan(tagReplace, 6, 7, 5, 6), some('d'), none(char))])
+    check(len(newDiff(@[1, 2], @[1, 2]).anchoredChanges()) == 0)
+    check(newDiff(@[1], @[2]).anchoredChanges() ==
+          @[(newSpan(tagReplace, 0, 1, 0, 1), none(int), none(int))])
+    let split = newDiff(@[0, 1, 2, 3], @[0, 4, 5, 3],
+                        replaceThreshold = 0.5)
+    check(split.anchoredChanges() ==
+          @[(newSpan(tagDelete, 1, 3, 1, 1), some(0), some(3)),
+            (newSpan(tagInsert, 3, 3, 1, 3), some(0), some(3))])
+
+  test "123":
+    let (onlyA, onlyB, both) = setDiff(@[3, 1, 2, 2, 2, 5],
+                                       @[2, 4, 1, 2, 4])
+    check(onlyA == @[2, 3, 5])
+    check(onlyB == @[4, 4])
+    check(both == @[1, 2, 2])
+    check(setDiff(@["b", "a"], @["a", "b"]) ==
+          (newSeq[string](), newSeq[string](), @["a", "b"]))
+    check(setDiff(newSeq[int](), @[1, 1]) ==
+          (newSeq[int](), @[1, 1], newSeq[int]()))